@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// adminShutdownHandler calls stop for requests authorized with token as bearer token, which
+// shuts the service down as SIGTERM does: in-flight requests are drained and the telemetry
+// flushed. The response is written first, the server waits for it while draining.
+func adminShutdownHandler(token string, stop func(error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		presented, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		// Compared in constant time so the token can't be guessed from the response times
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "a valid ADMIN_TOKEN bearer token is required",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status": "shutting down",
+		})
+		stop(errors.New("shutdown requested on /admin/shutdown"))
+	}
+}
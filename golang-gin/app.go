@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	logsdk "go.opentelemetry.io/otel/sdk/log"
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"log"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// App is the configured service: its telemetry providers, routes and server.
+type App struct {
+	// TracerProvider is nil when tracing is disabled
+	TracerProvider *tracesdk.TracerProvider
+	// MeterProvider is nil when metrics are disabled
+	MeterProvider *metricsdk.MeterProvider
+	// LoggerProvider is nil unless OTEL_LOGS_EXPORTER is otlp
+	LoggerProvider *logsdk.LoggerProvider
+	Router         *gin.Engine
+	Server         *http.Server
+
+	cfg          Config
+	samplerRatio *ratioSampler
+	spans        *spanCounts
+	tracer       trace.TracerProvider
+	meter        metric.MeterProvider
+	propagator   propagation.TextMapPropagator
+	db           *sql.DB
+	// debugSpans is nil unless DEBUG_SPANS is set
+	debugSpans *spanBuffer
+
+	// stopped is cancelled by stop to shut down a running app from within, as on POST /admin/shutdown
+	stopped context.Context
+	stop    context.CancelCauseFunc
+
+	shutdownTracer func(context.Context) error
+	shutdownMeter  func(context.Context) error
+	shutdownLogger func(context.Context) error
+}
+
+// NewApp sets up telemetry and the routes for cfg. Telemetry that can't be set up is left out
+// with a log message, unless cfg.RequireExporter is set.
+func NewApp(cfg Config) (*App, error) {
+	propagator, err := newPropagator(cfg.Propagators)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RegisterGlobal {
+		otel.SetTextMapPropagator(propagator)
+	}
+	app := &App{
+		cfg:            cfg,
+		samplerRatio:   newRatioSampler(cfg.SamplerRatio),
+		spans:          &spanCounts{},
+		tracer:         tracenoop.NewTracerProvider(),
+		meter:          metricnoop.NewMeterProvider(),
+		propagator:     propagator,
+		shutdownTracer: func(context.Context) error { return nil },
+		shutdownMeter:  func(context.Context) error { return nil },
+		shutdownLogger: func(context.Context) error { return nil },
+	}
+	app.stopped, app.stop = context.WithCancelCause(context.Background())
+
+	extra := slices.Clone(cfg.SpanProcessors)
+	if cfg.DebugSpans {
+		app.debugSpans = newSpanBuffer(cfg.DebugSpansSize)
+		extra = append(extra, app.debugSpans)
+	}
+	tracerProvider, shutdownTracer, ready, err := InitTracer(context.Background(), cfg, app.samplerRatio, app.spans, extra...)
+	if err != nil && (cfg.RequireExporter || cfg.StartupCheck) {
+		return nil, fmt.Errorf("could not initialise tracer: %w", err)
+	} else if err != nil {
+		// The provider stays a no-op, so the server still runs, just without tracing
+		log.Print("Could not initialise tracer, continuing without tracing: ", err)
+		ready = func() error { return nil }
+	} else {
+		app.shutdownTracer = shutdownTracer
+	}
+	if tracerProvider != nil {
+		app.TracerProvider, app.tracer = tracerProvider, tracerProvider
+	}
+
+	meterProvider, shutdownMeter, metricsHandler, err := InitMeter(context.Background(), cfg)
+	if err != nil && cfg.RequireExporter {
+		return nil, errors.Join(fmt.Errorf("could not initialise meter: %w", err), app.shutdownTracer(context.Background()))
+	} else if err != nil {
+		log.Print("Could not initialise meter, continuing without metrics: ", err)
+	} else {
+		app.shutdownMeter = shutdownMeter
+	}
+	if meterProvider != nil {
+		app.MeterProvider, app.meter = meterProvider, meterProvider
+	}
+	loggerProvider, shutdownLogger, err := InitLogger(context.Background(), cfg)
+	if err != nil && cfg.RequireExporter {
+		return nil, errors.Join(fmt.Errorf("could not initialise logger: %w", err), app.Shutdown(context.Background()))
+	} else if err != nil {
+		log.Print("Could not initialise logger, continuing without log export: ", err)
+	} else {
+		app.shutdownLogger = shutdownLogger
+	}
+	if loggerProvider != nil {
+		app.LoggerProvider = loggerProvider
+		// The bridge takes the trace context from the record's context itself
+		if cfg.RegisterGlobal {
+			bridge := otelslog.NewHandler(instrumentationName, otelslog.WithLoggerProvider(loggerProvider))
+			slog.SetDefault(slog.New(fanoutHandler{slog.Default().Handler(), bridge}))
+		}
+	}
+
+	if err := pipelineMetrics(app.meter, app.spans); err != nil {
+		return nil, errors.Join(fmt.Errorf("could not create span pipeline metrics: %w", err), app.Shutdown(context.Background()))
+	}
+
+	if cfg.DatabaseURL != "" {
+		if app.db, err = openDatabase(context.Background(), cfg.DatabaseURL, app.tracer, app.meter); err != nil {
+			return nil, errors.Join(err, app.Shutdown(context.Background()))
+		}
+	}
+
+	if app.Router, err = app.newRouter(ready, metricsHandler); err != nil {
+		return nil, errors.Join(fmt.Errorf("could not create router: %w", err), app.Shutdown(context.Background()))
+	}
+	app.Server = &http.Server{Addr: cfg.ListenAddr, Handler: app.Router}
+	if cfg.EnableH2C {
+		// Plaintext HTTP/2 is only spoken by the h2c handler, configuring the server lets
+		// Shutdown drain its connections too
+		h2s := &http2.Server{}
+		app.Server.Handler = h2c.NewHandler(app.Router, h2s)
+		if err := http2.ConfigureServer(app.Server, h2s); err != nil {
+			return nil, errors.Join(fmt.Errorf("could not enable h2c: %w", err), app.Shutdown(context.Background()))
+		}
+	}
+	return app, nil
+}
+
+// SetSamplerRatio changes the ratio of the traceidratio and parentbased_traceidratio samplers,
+// the other samplers don't have one.
+func (a *App) SetSamplerRatio(ratio float64) {
+	a.samplerRatio.SetRatio(ratio)
+}
+
+// Run serves until the server fails, ctx is done or a shutdown is requested on POST
+// /admin/shutdown, then stops accepting new connections and waits up to the shutdown grace
+// period for in-flight requests to complete.
+func (a *App) Run(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- a.Server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		log.Print("Shutting down: ", context.Cause(ctx))
+	case <-a.stopped.Done():
+		log.Print("Shutting down: ", context.Cause(a.stopped))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.cfg.ShutdownGracePeriod)
+	defer cancel()
+	return a.Server.Shutdown(ctx)
+}
+
+// Shutdown closes the server, draining it within ctx, and the database. The telemetry is then
+// flushed within SHUTDOWN_EXPORT_TIMEOUT, so an aggressive drain deadline doesn't cut the export
+// of the buffered spans short. Called after Run the server is already closed, so the order is:
+// stop accepting connections, drain active handlers, flush the exporters. Flushing earlier would
+// drop the spans of requests that were still in flight.
+func (a *App) Shutdown(ctx context.Context) error {
+	var err error
+	if a.Server != nil {
+		err = a.Server.Shutdown(ctx)
+	}
+	if a.db != nil {
+		err = errors.Join(err, a.db.Close())
+	}
+
+	exportCtx, cancel := context.WithTimeout(context.Background(), a.cfg.ShutdownExportTimeout)
+	defer cancel()
+	if shutdownErr := a.shutdownTracer(exportCtx); shutdownErr != nil {
+		err = errors.Join(err, fmt.Errorf("could not shut down tracer: %w", shutdownErr))
+	}
+	if shutdownErr := a.shutdownMeter(exportCtx); shutdownErr != nil {
+		err = errors.Join(err, fmt.Errorf("could not shut down meter: %w", shutdownErr))
+	}
+	// Last, so the records logged while shutting down are still exported
+	if shutdownErr := a.shutdownLogger(exportCtx); shutdownErr != nil {
+		err = errors.Join(err, fmt.Errorf("could not shut down logger: %w", shutdownErr))
+	}
+	return err
+}
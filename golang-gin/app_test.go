@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// keptSpans is an in-memory exporter that keeps its spans when shut down.
+type keptSpans struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keptSpans) Shutdown(context.Context) error { return nil }
+
+func TestShutdownOnSIGTERM(t *testing.T) {
+	exporter := keptSpans{tracetest.NewInMemoryExporter()}
+	addr := freeAddr(t)
+	app, _ := newTestApp(t, func(cfg *Config) {
+		cfg.ListenAddr = addr
+		// Nothing is exported before shutdown unless it flushes the batch
+		cfg.SpanProcessors = []tracesdk.SpanProcessor{
+			tracesdk.NewBatchSpanProcessor(exporter, tracesdk.WithBatchTimeout(time.Hour)),
+		}
+	})
+	stopped := make(chan error, 1)
+	go func() { stopped <- runUntilSignal(app, time.Second) }()
+
+	// Once the server answers the signal handler is installed, and SIGTERM no longer kills the test
+	response := getWhenListening(t, "http://"+addr+"/ping")
+	response.Body.Close()
+	if len(exporter.GetSpans()) != 0 {
+		t.Fatal("spans were exported before shutdown")
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("runUntilSignal returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM didn't stop the server")
+	}
+
+	if server := serverSpans(exporter.GetSpans()); len(server) != 1 || server[0].Name != "GET /ping" {
+		t.Errorf("want the GET /ping span flushed on shutdown, got %v", server)
+	}
+}
+
+func TestSDKDisabled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var connections atomic.Int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+			conn.Close()
+		}
+	}()
+
+	app, spans := newTestApp(t, func(cfg *Config) {
+		cfg.SDKDisabled = true
+		cfg.Endpoint = listener.Addr().String()
+		cfg.Insecure = true
+		cfg.LogsExporter = "otlp"
+	})
+	serve(app, http.MethodGet, "/ping")
+	if err := app.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := connections.Load(); n != 0 {
+		t.Errorf("want no connection to the collector, got %d", n)
+	}
+	if len(spans()) != 0 {
+		t.Errorf("want no spans, got %d", len(spans()))
+	}
+}
+
+func TestH2CPropagatesTraceparent(t *testing.T) {
+	app, spans := newTestApp(t, func(cfg *Config) {
+		cfg.EnableH2C = true
+	})
+	server := httptest.NewServer(app.Server.Handler)
+	defer server.Close()
+	// Prior knowledge HTTP/2 over plain TCP, as a gRPC style client speaks it
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.ProtoMajor != 2 || response.StatusCode != http.StatusOK {
+		t.Fatalf("want a 200 over HTTP/2, got %d over %s", response.StatusCode, response.Proto)
+	}
+
+	// Waits for the handler, and so its span, to finish
+	server.Close()
+	spanStubs := serverSpans(spans())
+	if len(spanStubs) != 1 {
+		t.Fatalf("want one server span, got %v", spanStubs)
+	}
+	parent := spanStubs[0].Parent
+	if parent.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || parent.SpanID().String() != "00f067aa0ba902b7" || !parent.IsRemote() {
+		t.Errorf("want the server span to continue the incoming trace, got parent %v", parent)
+	}
+}
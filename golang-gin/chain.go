@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// maxChainDepth caps how often /chain calls itself.
+const maxChainDepth = 5
+
+// chainHandler calls /chain on this service again with depth decremented until it reaches 0,
+// so one request produces a chain of client and server spans in a single trace, as a call
+// through several services would. Every hop reports its span context, showing how they nest, and
+// passes its depth on in the traceStateKey tracestate entry.
+//
+// Every hop holds a MAX_CONCURRENT_REQUESTS slot while it waits for the next one, so a chain of
+// depth n needs n+1 slots at once. The depth is capped below maxConcurrent, when it is set, so on
+// its own a chain can't wait for a slot only it could free.
+func chainHandler(client *http.Client, self, traceStateKey string, maxConcurrent int) gin.HandlerFunc {
+	maxDepth := maxChainDepth
+	if maxConcurrent > 0 {
+		maxDepth = min(maxDepth, maxConcurrent-1)
+	}
+	return func(c *gin.Context) {
+		depth, err := strconv.Atoi(c.DefaultQuery("depth", strconv.Itoa(min(3, maxDepth))))
+		if err != nil || depth < 0 || depth > maxDepth {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("depth must be a number between 0 and %d", maxDepth),
+			})
+			return
+		}
+		spanContext := trace.SpanContextFromContext(c.Request.Context())
+		hop := gin.H{
+			"depth":    depth,
+			"trace_id": spanContext.TraceID().String(),
+			"span_id":  spanContext.SpanID().String(),
+		}
+		if depth == 0 {
+			c.JSON(http.StatusOK, hop)
+			return
+		}
+
+		ctx, err := withTraceState(c.Request.Context(), traceStateKey, strconv.Itoa(depth))
+		if err != nil {
+			slog.WarnContext(ctx, "Not passing the depth on in the tracestate", "error", err)
+		}
+		url := fmt.Sprintf("%s/chain?depth=%d", self, depth-1)
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		defer response.Body.Close()
+		var next gin.H
+		if err := json.NewDecoder(response.Body).Decode(&next); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		hop["next"] = next
+		c.JSON(response.StatusCode, hop)
+	}
+}
+
+// selfURL is the base URL this service can reach itself on, listenAddr is a valid LISTEN_ADDR.
+func selfURL(listenAddr string) string {
+	host, port, _ := net.SplitHostPort(listenAddr)
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	// The chain calls the server on LISTEN_ADDR, so it has to be known up front
+	addr := freeAddr(t)
+	app, spans := newTestApp(t, func(cfg *Config) {
+		cfg.ListenAddr = addr
+		cfg.MaxConcurrentRequests = 4
+		cfg.RequestTimeout = 2 * time.Second
+	})
+	ctx, cancel := context.WithCancelCause(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- app.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel(errors.New("test done"))
+		<-stopped
+	})
+
+	too := getWhenListening(t, "http://"+addr+"/chain?depth=4")
+	too.Body.Close()
+	// Needs five slots, it would wait for the request timeout
+	if too.StatusCode != http.StatusBadRequest {
+		t.Errorf("depth 4: got %d, want 400", too.StatusCode)
+	}
+
+	response := getWhenListening(t, "http://"+addr+"/chain?depth=3")
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("depth 3: got %d, want 200", response.StatusCode)
+	}
+	var hop chainHop
+	if err := json.NewDecoder(response.Body).Decode(&hop); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every server span is the child of the client span of the hop before it
+	byID := map[string]tracetest.SpanStub{}
+	for _, span := range spans() {
+		byID[span.SpanContext.SpanID().String()] = span
+	}
+	for depth := 3; ; depth-- {
+		server, ok := byID[hop.SpanID]
+		if !ok || hop.Depth != depth || server.SpanKind != trace.SpanKindServer {
+			t.Fatalf("depth %d: want the hop to report its server span, got %+v", depth, hop)
+		}
+		if hop.TraceID != server.SpanContext.TraceID().String() {
+			t.Errorf("depth %d: reported trace %s, its span is in %s", depth, hop.TraceID, server.SpanContext.TraceID())
+		}
+		if hop.Next == nil {
+			break
+		}
+		if hop.Next.TraceID != hop.TraceID {
+			t.Errorf("depth %d: the next hop is in trace %s, want %s", depth, hop.Next.TraceID, hop.TraceID)
+		}
+		next, ok := byID[hop.Next.SpanID]
+		if !ok {
+			t.Fatalf("depth %d: no span for the next hop", depth)
+		}
+		client, ok := byID[next.Parent.SpanID().String()]
+		if !ok || client.SpanKind != trace.SpanKindClient || client.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("depth %d: want the next hop's parent to be a client span of %s, got %s %s with parent %s",
+				depth, server.SpanContext.SpanID(), client.SpanKind, next.Parent.SpanID(), client.Parent.SpanID())
+		}
+		hop = *hop.Next
+	}
+	if hop.Depth != 0 {
+		t.Errorf("the chain ended at depth %d", hop.Depth)
+	}
+}
+
+// chainHop is what every /chain hop responds with.
+type chainHop struct {
+	Depth   int       `json:"depth"`
+	TraceID string    `json:"trace_id"`
+	SpanID  string    `json:"span_id"`
+	Next    *chainHop `json:"next"`
+}
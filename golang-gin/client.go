@@ -0,0 +1,24 @@
+package main
+
+import (
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"time"
+)
+
+// newHTTPClient returns a client that creates a client span for every request and injects the
+// trace context into its headers. Requests must carry the handler's context for the span to
+// become a child of the server span.
+func newHTTPClient(tracerProvider trace.TracerProvider, meterProvider metric.MeterProvider, propagator propagation.TextMapPropagator) *http.Client {
+	return &http.Client{
+		Transport: otelhttp.NewTransport(http.DefaultTransport,
+			otelhttp.WithTracerProvider(tracerProvider),
+			otelhttp.WithMeterProvider(meterProvider),
+			otelhttp.WithPropagators(propagator),
+		),
+		Timeout: 10 * time.Second,
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collector owns the gRPC connection to the OTLP collector. It is connected eagerly
+// rather than on the first export so readiness reflects whether the collector is
+// reachable before any traffic arrives.
+type collector struct {
+	conn *grpc.ClientConn
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+// newCollector connects to OTEL_EXPORTER_OTLP_ENDPOINT, defaulting to localhost:4317 as the SDK does.
+func newCollector(cfg Config) (*collector, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "localhost:4317"
+	}
+	// gRPC wants a bare host:port, but the collector docs write the endpoint as a URL
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT %q: %w", endpoint, err)
+		}
+		endpoint = u.Host
+		cfg.Insecure = cfg.Insecure || u.Scheme == "http"
+	}
+	// The exporters ignore their transport and compression options when given a connection,
+	// so these have to be set up here
+	creds, err := transportCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &collector{}
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(c.dial),
+	}
+	if cfg.Compression == "gzip" {
+		options = append(options, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	}
+
+	conn, err := grpc.NewClient(endpoint, options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create collector connection: %w", err)
+	}
+	conn.Connect()
+	c.conn = conn
+	return c, nil
+}
+
+// transportCredentials is plaintext when OTEL_EXPORTER_OTLP_INSECURE is set, which is what local
+// collectors (Jaeger, otel-collector in docker-compose) usually listen on.
+func transportCredentials(cfg Config) (credentials.TransportCredentials, error) {
+	if cfg.Insecure {
+		return insecure.NewCredentials(), nil
+	}
+	tlsConfig, err := clientTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return credentials.NewClientTLSFromCert(nil, ""), nil
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// clientTLSConfig trusts the OTEL_EXPORTER_OTLP_CERTIFICATE CA instead of the system ones and
+// presents the OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE to collectors requiring mutual TLS. It is
+// nil when neither is configured, leaving the exporters' defaults in place.
+func clientTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.Certificate == "" && cfg.ClientCertificate == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if cfg.Certificate != "" {
+		pem, err := os.ReadFile(cfg.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("could not read OTEL_EXPORTER_OTLP_CERTIFICATE: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_CERTIFICATE %s: no PEM encoded certificate found", cfg.Certificate)
+		}
+	}
+	if cfg.ClientCertificate != "" {
+		// Fails for unreadable files as well as for a key that doesn't belong to the certificate
+		certificate, err := tls.LoadX509KeyPair(cfg.ClientCertificate, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE %s with OTEL_EXPORTER_OTLP_CLIENT_KEY %s: %w",
+				cfg.ClientCertificate, cfg.ClientKey, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// dial records the outcome of every connection attempt, gRPC only exposes the resulting state.
+func (c *collector) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+	return conn, err
+}
+
+// Ready returns nil once the connection is established, otherwise an error
+// describing the connection state and the last dial failure.
+func (c *collector) Ready() error {
+	state := c.conn.GetState()
+	if state == connectivity.Ready {
+		return nil
+	}
+	if state == connectivity.Idle {
+		// The connection is dropped after the idle timeout, wake it up again
+		c.conn.Connect()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastErr != nil {
+		return fmt.Errorf("collector connection is %s: %w", state, c.lastErr)
+	}
+	return fmt.Errorf("collector connection is %s", state)
+}
+
+// WaitReady checks Ready up to retries more times, backing off exponentially in between.
+func (c *collector) WaitReady(ctx context.Context, retries int) error {
+	backoff := 250 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := c.Ready()
+		if err == nil || attempt == retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *collector) Close() error {
+	return c.conn.Close()
+}
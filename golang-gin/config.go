@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds everything the service reads from the environment, the README lists the variables.
+type Config struct {
+	ServiceName         string
+	ServiceVersion      string
+	Environment         string
+	ListenAddr          string
+	TrustedProxies      []string
+	ShutdownGracePeriod time.Duration
+	RequestTimeout      time.Duration
+	UserIDHeader        string
+	TraceStateKey       string
+	UpstreamURL         string
+	DatabaseURL         string
+	CORSAllowedOrigins  []string
+	RateLimit           float64
+	// MaxConcurrentRequests is unlimited when 0
+	MaxConcurrentRequests int
+	// EnableH2C serves HTTP/2 without TLS next to HTTP/1.1
+	EnableH2C bool
+
+	SDKDisabled         bool
+	TracesExporters     []string
+	RequireExporter     bool
+	MetricsExporter     string
+	LogsExporter        string
+	ExemplarFilter      string
+	Endpoint            string
+	Protocol            string
+	Insecure            bool
+	Compression         string
+	Headers             map[string]string
+	ExportTimeout       time.Duration
+	StartupRetries      int
+	StartupCheck        bool
+	RetryMaxElapsedTime time.Duration
+
+	// Certificate is the CA file, ClientCertificate and ClientKey authenticate to the collector
+	Certificate       string
+	ClientCertificate string
+	ClientKey         string
+
+	Sampler          string
+	SamplerRatio     float64
+	SamplerDenyPaths []string
+	Propagators      []string
+	// StrictTraceparent rejects requests with a malformed traceparent
+	StrictTraceparent bool
+	// BaggageSpanKeys are the baggage members recorded on the server span
+	BaggageSpanKeys []string
+
+	// AttributeValueLengthLimit truncates longer string attributes, -1 for unlimited
+	AttributeValueLengthLimit int
+
+	// SensitiveHeaders have their values redacted from span attributes
+	SensitiveHeaders []string
+
+	// RegisterGlobal installs the providers and propagator as the otel globals. LoadConfig sets
+	// it, tests can leave it unset to run isolated providers side by side
+	RegisterGlobal bool
+
+	// SpanProcessors receive every span besides the exporters, such as a test's in-memory
+	// recorder. They can't be set from the environment
+	SpanProcessors []tracesdk.SpanProcessor
+
+	// CriticalRoutes have their spans exported when the request completes
+	CriticalRoutes []string
+
+	// Zero batch settings leave the SDK defaults in place
+	BatchScheduleDelay time.Duration
+	BatchExportTimeout time.Duration
+	BatchMaxExportSize int
+	BatchMaxQueueSize  int
+
+	// ShutdownExportTimeout bounds flushing the telemetry after the server is drained
+	ShutdownExportTimeout time.Duration
+
+	// AdminToken enables POST /admin/shutdown for requests bearing it
+	AdminToken string
+
+	// DebugSpans keeps the last DebugSpansSize spans in memory for GET /debug/spans
+	DebugSpans     bool
+	DebugSpansSize int
+}
+
+// LoadConfig reads and validates the environment, reporting every malformed variable at once.
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		ServiceName:         "app",
+		ServiceVersion:      version,
+		Environment:         "development",
+		ListenAddr:          ":8080",
+		ShutdownGracePeriod: 10 * time.Second,
+		RequestTimeout:      30 * time.Second,
+		UserIDHeader:        "X-User-ID",
+		TraceStateKey:       "demo",
+		UpstreamURL:         os.Getenv("UPSTREAM_URL"),
+		DatabaseURL:         os.Getenv("DATABASE_URL"),
+		MetricsExporter:     "otlp",
+		ExemplarFilter:      "trace_based",
+		Endpoint:            os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		Protocol:            "grpc",
+		Compression:         "none",
+		ExportTimeout:       10 * time.Second,
+		StartupRetries:      5,
+		RetryMaxElapsedTime: time.Minute,
+		Sampler:             "parentbased_always_on",
+		SamplerRatio:        1,
+		SamplerDenyPaths:    []string{"/healthz", "/readyz", "/metrics", "/version"},
+		SensitiveHeaders:    []string{"authorization", "proxy-authorization", "cookie", "set-cookie", "x-api-key"},
+		RegisterGlobal:      true,
+	}
+	cfg.AttributeValueLengthLimit = tracesdk.DefaultAttributeValueLengthLimit
+	cfg.ShutdownExportTimeout = 15 * time.Second
+	cfg.DebugSpansSize = 100
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.ListenAddr = ":" + port
+	}
+	lookupString("LISTEN_ADDR", &cfg.ListenAddr)
+	lookupString("OTEL_SERVICE_NAME", &cfg.ServiceName)
+	lookupString("OTEL_SERVICE_VERSION", &cfg.ServiceVersion)
+	lookupString("DEPLOYMENT_ENV", &cfg.Environment)
+	lookupString("USER_ID_HEADER", &cfg.UserIDHeader)
+	lookupString("TRACESTATE_KEY", &cfg.TraceStateKey)
+	lookupString("METRICS_EXPORTER", &cfg.MetricsExporter)
+	lookupString("OTEL_METRICS_EXEMPLAR_FILTER", &cfg.ExemplarFilter)
+	lookupString("OTEL_EXPORTER_OTLP_PROTOCOL", &cfg.Protocol)
+	lookupString("OTEL_EXPORTER_OTLP_COMPRESSION", &cfg.Compression)
+	lookupString("OTEL_TRACES_SAMPLER", &cfg.Sampler)
+
+	// Several exporters may be listed, e.g. otlp,console to also see the spans locally
+	tracesExporters := "otlp"
+	lookupString("OTEL_TRACES_EXPORTER", &tracesExporters)
+	cfg.LogsExporter = "none"
+	lookupString("OTEL_LOGS_EXPORTER", &cfg.LogsExporter)
+
+	lookupString("ADMIN_TOKEN", &cfg.AdminToken)
+	lookupString("OTEL_EXPORTER_OTLP_CERTIFICATE", &cfg.Certificate)
+	lookupString("OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE", &cfg.ClientCertificate)
+	lookupString("OTEL_EXPORTER_OTLP_CLIENT_KEY", &cfg.ClientKey)
+
+	// Baggage may submit too much sensitive data for production, so it has to be opted into
+	enableBaggage := false
+	propagators := "tracecontext"
+	lookupString("OTEL_PROPAGATORS", &propagators)
+
+	err := errors.Join(
+		lookup("SHUTDOWN_GRACE_PERIOD", &cfg.ShutdownGracePeriod, time.ParseDuration),
+		lookup("SHUTDOWN_EXPORT_TIMEOUT", &cfg.ShutdownExportTimeout, time.ParseDuration),
+		lookup("REQUEST_TIMEOUT", &cfg.RequestTimeout, time.ParseDuration),
+		lookup("OTEL_SDK_DISABLED", &cfg.SDKDisabled, strconv.ParseBool),
+		lookup("REQUIRE_EXPORTER", &cfg.RequireExporter, strconv.ParseBool),
+		lookup("OTEL_EXPORTER_OTLP_INSECURE", &cfg.Insecure, strconv.ParseBool),
+		lookup("OTEL_EXPORTER_OTLP_HEADERS", &cfg.Headers, parseHeaders),
+		lookup("OTEL_EXPORTER_OTLP_TIMEOUT", &cfg.ExportTimeout, parseMilliseconds),
+		lookup("EXPORTER_STARTUP_CHECK", &cfg.StartupCheck, strconv.ParseBool),
+		lookup("EXPORTER_STARTUP_RETRIES", &cfg.StartupRetries, strconv.Atoi),
+		lookup("EXPORTER_RETRY_MAX_ELAPSED_TIME", &cfg.RetryMaxElapsedTime, time.ParseDuration),
+		lookup("TRUSTED_PROXIES", &cfg.TrustedProxies, parseList),
+		lookup("ENABLE_H2C", &cfg.EnableH2C, strconv.ParseBool),
+		lookup("MAX_CONCURRENT_REQUESTS", &cfg.MaxConcurrentRequests, strconv.Atoi),
+		lookup("RATE_LIMIT", &cfg.RateLimit, parseFloat),
+		lookup("OTEL_SPAN_ATTRIBUTE_VALUE_LENGTH_LIMIT", &cfg.AttributeValueLengthLimit, strconv.Atoi),
+		lookup("SENSITIVE_HEADERS", &cfg.SensitiveHeaders, parseList),
+		lookup("CRITICAL_ROUTES", &cfg.CriticalRoutes, parseList),
+		lookup("DEBUG_SPANS", &cfg.DebugSpans, strconv.ParseBool),
+		lookup("DEBUG_SPANS_SIZE", &cfg.DebugSpansSize, strconv.Atoi),
+		lookup("CORS_ALLOWED_ORIGINS", &cfg.CORSAllowedOrigins, parseList),
+		lookup("SAMPLER_DENY_PATHS", &cfg.SamplerDenyPaths, parseList),
+		lookup("OTEL_TRACES_SAMPLER_ARG", &cfg.SamplerRatio, parseRatio),
+		lookup("STRICT_TRACEPARENT", &cfg.StrictTraceparent, strconv.ParseBool),
+		lookup("ENABLE_BAGGAGE", &enableBaggage, strconv.ParseBool),
+		lookup("BAGGAGE_SPAN_KEYS", &cfg.BaggageSpanKeys, parseList),
+		lookup("OTEL_BSP_SCHEDULE_DELAY", &cfg.BatchScheduleDelay, parseMilliseconds),
+		lookup("OTEL_BSP_EXPORT_TIMEOUT", &cfg.BatchExportTimeout, parseMilliseconds),
+		lookup("OTEL_BSP_MAX_EXPORT_BATCH_SIZE", &cfg.BatchMaxExportSize, strconv.Atoi),
+		lookup("OTEL_BSP_MAX_QUEUE_SIZE", &cfg.BatchMaxQueueSize, strconv.Atoi),
+		oneOf("METRICS_EXPORTER", cfg.MetricsExporter, "otlp", "prometheus"),
+		oneOf("OTEL_LOGS_EXPORTER", cfg.LogsExporter, "otlp", "none"),
+		oneOf("OTEL_METRICS_EXEMPLAR_FILTER", cfg.ExemplarFilter, "trace_based", "always_on", "always_off"),
+		oneOf("OTEL_EXPORTER_OTLP_PROTOCOL", cfg.Protocol, "grpc", "http/protobuf"),
+		oneOf("OTEL_EXPORTER_OTLP_COMPRESSION", cfg.Compression, "gzip", "none"),
+		oneOf("OTEL_TRACES_SAMPLER", cfg.Sampler, "always_on", "always_off", "traceidratio",
+			"parentbased_always_on", "parentbased_always_off", "parentbased_traceidratio"),
+	)
+	if _, _, splitErr := net.SplitHostPort(cfg.ListenAddr); splitErr != nil {
+		err = errors.Join(err, fmt.Errorf("invalid LISTEN_ADDR %q: %w", cfg.ListenAddr, splitErr))
+	}
+	if strings.Contains(cfg.Endpoint, "://") {
+		if u, parseErr := url.Parse(cfg.Endpoint); parseErr != nil {
+			err = errors.Join(err, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT %q: %w", cfg.Endpoint, parseErr))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			err = errors.Join(err, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT %q: must be host:port or an http(s)://host:port URL", cfg.Endpoint))
+		}
+	}
+	if (cfg.ClientCertificate == "") != (cfg.ClientKey == "") {
+		err = errors.Join(err, errors.New("OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE and OTEL_EXPORTER_OTLP_CLIENT_KEY must be set together"))
+	}
+	if cfg.RequestTimeout <= 0 {
+		err = errors.Join(err, fmt.Errorf("invalid REQUEST_TIMEOUT %s: must be positive", cfg.RequestTimeout))
+	}
+	if cfg.MaxConcurrentRequests < 0 {
+		err = errors.Join(err, fmt.Errorf("invalid MAX_CONCURRENT_REQUESTS %d: must not be negative", cfg.MaxConcurrentRequests))
+	}
+	if cfg.RateLimit < 0 {
+		err = errors.Join(err, fmt.Errorf("invalid RATE_LIMIT %v: must not be negative", cfg.RateLimit))
+	}
+	if cfg.StartupRetries < 0 {
+		err = errors.Join(err, fmt.Errorf("invalid EXPORTER_STARTUP_RETRIES %d: must not be negative", cfg.StartupRetries))
+	}
+	if os.Getenv("OTEL_SPAN_ATTRIBUTE_VALUE_LENGTH_LIMIT") != "" && cfg.AttributeValueLengthLimit <= 0 {
+		err = errors.Join(err, fmt.Errorf("invalid OTEL_SPAN_ATTRIBUTE_VALUE_LENGTH_LIMIT %d: must be positive", cfg.AttributeValueLengthLimit))
+	}
+	if cfg.DebugSpansSize <= 0 {
+		err = errors.Join(err, fmt.Errorf("invalid DEBUG_SPANS_SIZE %d: must be positive", cfg.DebugSpansSize))
+	}
+	if cfg.BatchMaxExportSize < 0 || cfg.BatchMaxQueueSize < 0 {
+		err = errors.Join(err, errors.New("invalid OTEL_BSP_MAX_EXPORT_BATCH_SIZE or OTEL_BSP_MAX_QUEUE_SIZE: must not be negative"))
+	}
+
+	for _, name := range strings.Split(tracesExporters, ",") {
+		name = strings.TrimSpace(name)
+		err = errors.Join(err, oneOf("OTEL_TRACES_EXPORTER", name, "otlp", "console", "stdout"))
+		if !slices.Contains(cfg.TracesExporters, name) {
+			cfg.TracesExporters = append(cfg.TracesExporters, name)
+		}
+	}
+
+	if enableBaggage && os.Getenv("OTEL_PROPAGATORS") == "" {
+		propagators += ",baggage"
+	}
+	for _, name := range strings.Split(propagators, ",") {
+		name = strings.TrimSpace(name)
+		err = errors.Join(err, oneOf("OTEL_PROPAGATORS", name, "tracecontext", "baggage", "b3", "b3multi", "jaeger", "none"))
+		cfg.Propagators = append(cfg.Propagators, name)
+	}
+
+	return cfg, err
+}
+
+// LoadSamplerRatio reads the sampling ratio again for a running service. As the environment
+// can't be changed from outside the process, it is read from the file named by
+// OTEL_TRACES_SAMPLER_ARG_FILE where that is set, and from OTEL_TRACES_SAMPLER_ARG otherwise.
+func LoadSamplerRatio() (float64, error) {
+	ratio := 1.0
+	if name := os.Getenv("OTEL_TRACES_SAMPLER_ARG_FILE"); name != "" {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			return 0, fmt.Errorf("could not read OTEL_TRACES_SAMPLER_ARG_FILE: %w", err)
+		}
+		if ratio, err = parseRatio(strings.TrimSpace(string(content))); err != nil {
+			return 0, fmt.Errorf("invalid sampling ratio in %s: %w", name, err)
+		}
+		return ratio, nil
+	}
+	err := lookup("OTEL_TRACES_SAMPLER_ARG", &ratio, parseRatio)
+	return ratio, err
+}
+
+// lookupString overwrites target with the variable when it is set and not empty.
+func lookupString(name string, target *string) {
+	if value := os.Getenv(name); value != "" {
+		*target = value
+	}
+}
+
+// lookup parses the variable into target when it is set and not empty.
+func lookup[T any](name string, target *T, parse func(string) (T, error)) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	*target = parsed
+	return nil
+}
+
+func oneOf(name, value string, allowed ...string) error {
+	if slices.Contains(allowed, value) {
+		return nil
+	}
+	return fmt.Errorf("unsupported %s %q: must be one of %s", name, value, strings.Join(allowed, ", "))
+}
+
+// parseHeaders reads the comma separated key=value pairs of OTEL_EXPORTER_OTLP_HEADERS, where
+// values are URL encoded as in the spec.
+func parseHeaders(value string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, encoded, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("header %q is not a key=value pair", strings.TrimSpace(pair))
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("header %q: %w", key, err)
+		}
+		headers[key] = decoded
+	}
+	return headers, nil
+}
+
+// parseList splits a comma separated list, dropping empty entries.
+func parseList(value string) ([]string, error) {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list, nil
+}
+
+func parseFloat(value string) (float64, error) {
+	return strconv.ParseFloat(value, 64)
+}
+
+func parseRatio(value string) (float64, error) {
+	ratio, err := parseFloat(value)
+	if err != nil {
+		return 0, err
+	}
+	if ratio < 0 || ratio > 1 {
+		return 0, errors.New("must be a ratio between 0 and 1")
+	}
+	return ratio, nil
+}
+
+// parseMilliseconds reads the plain millisecond integers the OTEL_BSP_* and timeout variables use.
+func parseMilliseconds(value string) (time.Duration, error) {
+	milliseconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if milliseconds <= 0 {
+		return 0, errors.New("must be a positive number of milliseconds")
+	}
+	return time.Duration(milliseconds) * time.Millisecond, nil
+}
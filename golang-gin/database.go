@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	_ "modernc.org/sqlite"
+)
+
+// openDatabase opens the SQLite database at dsn through otelsql, so every query becomes a
+// db.system/db.statement span under the request span, and seeds the users table.
+func openDatabase(ctx context.Context, dsn string, tracerProvider trace.TracerProvider, meterProvider metric.MeterProvider) (*sql.DB, error) {
+	db, err := otelsql.Open("sqlite", dsn,
+		otelsql.WithAttributes(semconv.DBSystemSqlite),
+		otelsql.WithTracerProvider(tracerProvider),
+		otelsql.WithMeterProvider(meterProvider),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not open database: %w", err)
+	}
+	// SQLite allows a single writer, and every connection to :memory: would get its own database
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(ctx, db); err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+	return db, nil
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	for _, statement := range []string{
+		`CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, name TEXT NOT NULL)`,
+		`INSERT OR IGNORE INTO users (id, name) VALUES (1, 'Ada Lovelace'), (2, 'Grace Hopper'), (3, 'Alan Turing')`,
+	} {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("could not migrate database: %w", err)
+		}
+	}
+	return nil
+}
+
+type user struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func listUsers(ctx context.Context, db *sql.DB) ([]user, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, name FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []user{}
+	for rows.Next() {
+		var u user
+		if err := rows.Scan(&u.ID, &u.Name); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func getUser(ctx context.Context, db *sql.DB, id string) (user, error) {
+	var u user
+	err := db.QueryRowContext(ctx, `SELECT id, name FROM users WHERE id = ?`, id).Scan(&u.ID, &u.Name)
+	return u, err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// spanBuffer is a span processor keeping the last spans that ended in a ring buffer, so they
+// can be inspected on GET /debug/spans without a tracing backend.
+type spanBuffer struct {
+	mu    sync.Mutex
+	spans []tracesdk.ReadOnlySpan
+	// next is where the following span is stored, overwriting the oldest once the buffer is full
+	next int
+	full bool
+}
+
+func newSpanBuffer(size int) *spanBuffer {
+	return &spanBuffer{spans: make([]tracesdk.ReadOnlySpan, size)}
+}
+
+func (b *spanBuffer) OnStart(context.Context, tracesdk.ReadWriteSpan) {}
+
+func (b *spanBuffer) OnEnd(s tracesdk.ReadOnlySpan) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.spans[b.next] = s
+	b.next = (b.next + 1) % len(b.spans)
+	b.full = b.full || b.next == 0
+}
+
+func (b *spanBuffer) Shutdown(context.Context) error { return nil }
+
+func (b *spanBuffer) ForceFlush(context.Context) error { return nil }
+
+// Spans returns the buffered spans, the most recent first.
+func (b *spanBuffer) Spans() []tracesdk.ReadOnlySpan {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	count := b.next
+	if b.full {
+		count = len(b.spans)
+	}
+	spans := make([]tracesdk.ReadOnlySpan, 0, count)
+	for i := 1; i <= count; i++ {
+		spans = append(spans, b.spans[(b.next-i+len(b.spans))%len(b.spans)])
+	}
+	return spans
+}
+
+type debugSpan struct {
+	Name         string         `json:"name"`
+	TraceID      string         `json:"trace_id"`
+	SpanID       string         `json:"span_id"`
+	ParentSpanID string         `json:"parent_span_id,omitempty"`
+	Kind         string         `json:"kind"`
+	Start        time.Time      `json:"start"`
+	DurationMS   float64        `json:"duration_ms"`
+	Status       string         `json:"status"`
+	Description  string         `json:"status_description,omitempty"`
+	Attributes   map[string]any `json:"attributes"`
+}
+
+// debugSpansHandler dumps the spans in buffer as JSON.
+func debugSpansHandler(buffer *spanBuffer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		spans := buffer.Spans()
+		dump := make([]debugSpan, len(spans))
+		for i, s := range spans {
+			dump[i] = debugSpan{
+				Name:        s.Name(),
+				TraceID:     s.SpanContext().TraceID().String(),
+				SpanID:      s.SpanContext().SpanID().String(),
+				Kind:        s.SpanKind().String(),
+				Start:       s.StartTime(),
+				DurationMS:  float64(s.EndTime().Sub(s.StartTime()).Microseconds()) / 1000,
+				Status:      s.Status().Code.String(),
+				Description: s.Status().Description,
+				Attributes:  make(map[string]any, len(s.Attributes())),
+			}
+			if s.Parent().IsValid() {
+				dump[i].ParentSpanID = s.Parent().SpanID().String()
+			}
+			for _, kv := range s.Attributes() {
+				dump[i].Attributes[string(kv.Key)] = kv.Value.AsInterface()
+			}
+		}
+		c.JSON(http.StatusOK, dump)
+	}
+}
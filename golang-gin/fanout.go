@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
+)
+
+// maxFanout caps the n query parameter of /fanout.
+const maxFanout = 10
+
+// fanout runs n tasks concurrently and waits for all of them. Each task is the root of its own
+// trace with a link back to the request span, as a batch job would be, so a slow task doesn't
+// stretch the request trace and the backend can still navigate between them.
+func fanout(ctx context.Context, tracer trace.Tracer, n int) []string {
+	origin := trace.LinkFromContext(ctx, attribute.String("fanout.role", "origin"))
+
+	results := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// ctx is still passed on so the request deadline cancels the tasks
+			taskCtx, span := tracer.Start(ctx, "fanout-task",
+				trace.WithNewRoot(),
+				trace.WithLinks(origin),
+				trace.WithAttributes(attribute.Int("fanout.index", i)),
+			)
+			defer span.End()
+
+			select {
+			case <-time.After(time.Duration(10*(i+1)) * time.Millisecond):
+				results[i] = span.SpanContext().TraceID().String()
+			case <-taskCtx.Done():
+				span.RecordError(taskCtx.Err())
+			}
+		}()
+	}
+	// The request span must not end before the tasks linking to it are done
+	wg.Wait()
+	return results
+}
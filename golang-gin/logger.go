@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	logsdk "go.opentelemetry.io/otel/sdk/log"
+	"log/slog"
+)
+
+// InitLogger creates a LoggerProvider exporting through OTEL_LOGS_EXPORTER. The provider is nil
+// when logs are not exported, which is the default, as the collector needs a logs pipeline.
+func InitLogger(ctx context.Context, cfg Config) (*logsdk.LoggerProvider, func(context.Context) error, error) {
+	disabled := func(context.Context) error { return nil }
+	if cfg.SDKDisabled || cfg.LogsExporter == "none" {
+		return nil, disabled, nil
+	}
+	if cfg.Endpoint == "" {
+		if cfg.RequireExporter {
+			return nil, nil, errors.New("OTLP endpoint not configured, set OTEL_EXPORTER_OTLP_ENDPOINT")
+		}
+		slog.Warn("OTLP endpoint not configured; log export disabled")
+		return nil, disabled, nil
+	}
+
+	exporter, closeConn, err := newOTLPLogExporter(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	loggerProvider := logsdk.NewLoggerProvider(
+		logsdk.WithProcessor(logsdk.NewBatchProcessor(exporter)),
+		logsdk.WithResource(newResource(ctx, cfg)),
+	)
+	shutdown := func(ctx context.Context) error {
+		// Shutting down the provider exports the buffered records before closing the exporter
+		return errors.Join(loggerProvider.Shutdown(ctx), closeConn())
+	}
+	return loggerProvider, shutdownOnce(shutdown), nil
+}
+
+// newOTLPLogExporter is the logs counterpart of newOTLPMetricExporter.
+func newOTLPLogExporter(ctx context.Context, cfg Config) (logsdk.Exporter, func() error, error) {
+	switch cfg.Protocol {
+	case "grpc":
+		collector, err := newCollector(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err := otlploggrpc.New(ctx,
+			otlploggrpc.WithGRPCConn(collector.conn),
+			otlploggrpc.WithHeaders(cfg.Headers),
+			otlploggrpc.WithTimeout(cfg.ExportTimeout),
+			otlploggrpc.WithRetry(otlploggrpc.RetryConfig(newExportRetry(cfg))),
+		)
+		if err != nil {
+			return nil, nil, errors.Join(fmt.Errorf("could not create log exporter: %w", err), collector.Close())
+		}
+		return exporter, collector.Close, nil
+	case "http/protobuf":
+		options, err := logHTTPOptions.build(cfg, "logs")
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err := otlploghttp.New(ctx, options...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not create log exporter: %w", err)
+		}
+		return exporter, func() error { return nil }, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported OTEL_EXPORTER_OTLP_PROTOCOL %q", cfg.Protocol)
+	}
+}
+
+// logHTTPOptions are the OTLP/HTTP log exporter's, see otlpHTTPOptions.
+var logHTTPOptions = otlpHTTPOptions[otlploghttp.Option]{
+	endpoint:  otlploghttp.WithEndpoint,
+	urlPath:   otlploghttp.WithURLPath,
+	insecure:  otlploghttp.WithInsecure,
+	tlsConfig: otlploghttp.WithTLSClientConfig,
+	gzip:      func() otlploghttp.Option { return otlploghttp.WithCompression(otlploghttp.GzipCompression) },
+	headers:   otlploghttp.WithHeaders,
+	timeout:   otlploghttp.WithTimeout,
+	retry:     func(r exportRetry) otlploghttp.Option { return otlploghttp.WithRetry(otlploghttp.RetryConfig(r)) },
+}
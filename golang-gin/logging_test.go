@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"go.opentelemetry.io/otel"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer the batch processor's goroutine can log to while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogOTelErrors(t *testing.T) {
+	logs := &syncBuffer{}
+	previousLogger, previousHandler := slog.Default(), otel.GetErrorHandler()
+	t.Cleanup(func() {
+		slog.SetDefault(previousLogger)
+		otel.SetErrorHandler(previousHandler)
+	})
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	logOTelErrors()
+
+	// Nothing listens on the port once it is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	app, _ := newTestApp(t, func(cfg *Config) {
+		cfg.Endpoint = "http://" + listener.Addr().String()
+		cfg.Protocol = "http/protobuf"
+		// Needs no collector, so only the span export fails
+		cfg.MetricsExporter = "prometheus"
+		cfg.ExportTimeout = 100 * time.Millisecond
+		cfg.RetryMaxElapsedTime = 100 * time.Millisecond
+		cfg.BatchScheduleDelay = 10 * time.Millisecond
+	})
+	serve(app, http.MethodGet, "/ping")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "OpenTelemetry error") {
+		if time.Now().After(deadline) {
+			t.Fatalf("the failed export was not logged, got %q", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,60 +2,368 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
-	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
-	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// untracedPaths are probe, scrape and diagnostic routes that would otherwise flood the backend with a span per call
+var untracedPaths = map[string]bool{
+	"/healthz":     true,
+	"/readyz":      true,
+	"/metrics":     true,
+	"/debug/spans": true,
+	"/version":     true,
+}
+
+// longLivedRoutes hold their connection open past the request, so REQUEST_TIMEOUT and
+// MAX_CONCURRENT_REQUESTS don't apply to them. Matched by route, not by the client's headers
+var longLivedRoutes = map[string]bool{
+	"/ws": true,
+}
+
+// maxSlowDuration caps how long /slow may take.
+const maxSlowDuration = 5 * time.Second
+
+// Build information, set with -ldflags "-X main.version=1.2.3 -X main.commit=... -X main.buildDate=..."
+var (
+	version   string
+	commit    string
+	buildDate string
 )
 
 func main() {
-	router := gin.Default()
+	slog.SetDefault(slog.New(traceHandler{slog.NewTextHandler(os.Stderr, nil)}))
+	logOTelErrors()
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	// gin defaults to debug mode, which prints every route and its warnings to stdout
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	app, err := NewApp(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			ratio, err := LoadSamplerRatio()
+			if err != nil {
+				log.Print("Could not reload the sampling ratio: ", err)
+				continue
+			}
+			app.SetSamplerRatio(ratio)
+			log.Print("Sampling ratio set to ", ratio)
+		}
+	}()
+
+	if err := runUntilSignal(app, cfg.ShutdownGracePeriod); err != nil {
+		log.Print(err)
+	}
+}
+
+// runUntilSignal serves until SIGINT or SIGTERM, then shuts the app down within gracePeriod.
+// Further signals are ignored until it returns, so a second Ctrl+C doesn't cut the flush short.
+func runUntilSignal(app *App, gracePeriod time.Duration) error {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case received := <-signals:
+			cancel(fmt.Errorf("received %s", received))
+		case <-ctx.Done():
+		}
+	}()
 
-	router.Use(otelgin.Middleware("app"))
+	if err := app.Run(ctx); err != nil {
+		log.Print("Server stopped: ", err)
+	}
+	// Run has already drained the server, unless it failed
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancelShutdown()
+	return app.Shutdown(shutdownCtx)
+}
+
+// newRouter registers the middleware and routes. ready reports exporter connectivity for /readyz,
+// /metrics is only served when metricsHandler is not nil, /users when there is a database,
+// /debug/spans when DEBUG_SPANS is set and /admin/shutdown when ADMIN_TOKEN is.
+func (a *App) newRouter(ready func() error, metricsHandler http.Handler) (*gin.Engine, error) {
+	cfg, db := a.cfg, a.db
+	metrics, err := metricsMiddleware(a.meter)
+	if err != nil {
+		return nil, fmt.Errorf("could not create HTTP metrics: %w", err)
+	}
+	pings, err := a.meter.Meter(instrumentationName).Int64Counter("ping.requests", metric.WithDescription("Number of /ping requests."))
+	if err != nil {
+		return nil, fmt.Errorf("could not create ping counter: %w", err)
+	}
+
+	// gin.Default's logger would log every request a second time, unstructured
+	router := gin.New()
+	router.Use(gin.Recovery())
+	// Without a list gin trusts X-Forwarded-For from any client, nil trusts none
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+
+	// Preflight requests are answered here, before otelgin would trace them
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		cors, err := corsMiddleware(cfg.CORSAllowedOrigins, cfg.UserIDHeader)
+		if err != nil {
+			return nil, err
+		}
+		router.Use(cors)
+	}
+
+	router.Use(samplingMiddleware(), debugTraceMiddleware(), routeMiddleware())
+	if a.TracerProvider != nil && len(cfg.CriticalRoutes) > 0 {
+		router.Use(flushMiddleware(a.TracerProvider, cfg.CriticalRoutes))
+	}
+	// otelgin already sets the span status to Error for 5xx responses and leaves 4xx Unset, as
+	// the HTTP semantic conventions require for server spans
+	router.Use(otelgin.Middleware(cfg.ServiceName,
+		otelgin.WithTracerProvider(a.tracer),
+		otelgin.WithPropagators(a.propagator),
+		otelgin.WithSpanNameFormatter(spanName),
+		otelgin.WithFilter(func(r *http.Request) bool {
+			return !untracedPaths[r.URL.Path]
+		}),
+	))
+	router.Use(accessLogMiddleware(), metrics, sizeMiddleware(), recoveryMiddleware(), deadlineMiddleware(), timeoutMiddleware(cfg.RequestTimeout))
+	if cfg.StrictTraceparent {
+		router.Use(strictTraceparentMiddleware())
+	}
+	// After the timeout middleware, so REQUEST_TIMEOUT bounds the wait for a slot
+	if cfg.MaxConcurrentRequests > 0 {
+		router.Use(concurrencyMiddleware(cfg.MaxConcurrentRequests))
+	}
+	if cfg.RateLimit > 0 {
+		router.Use(rateLimitMiddleware(cfg.RateLimit))
+	}
+	router.Use(userMiddleware(cfg.UserIDHeader), clientAddressMiddleware(), traceIDMiddleware(), requestIDMiddleware(), traceStateMiddleware(cfg.TraceStateKey))
+	if len(cfg.BaggageSpanKeys) > 0 {
+		router.Use(baggageSpanMiddleware(cfg.BaggageSpanKeys))
+	}
 
 	router.GET("/ping", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"message": "pong",
+		pings.Add(c.Request.Context(), 1)
+		slog.InfoContext(c.Request.Context(), "Responding to ping")
+
+		// A manually created span nests under the server span otelgin put in the request context
+		tracer := a.tracer.Tracer("ping-handler")
+		_, span := tracer.Start(c.Request.Context(), "compute-pong")
+		message := "pong"
+		span.AddEvent("pong computed")
+		span.End()
+
+		// WithSpan does the same for a step that may fail, this one can't
+		var format string
+		_ = WithSpan(c.Request.Context(), tracer, "prepare-response", func(context.Context) error {
+			// Probes and curl may ask for text, anything else keeps getting JSON
+			format = c.NegotiateFormat(gin.MIMEJSON, gin.MIMEPlain)
+			if format == "" {
+				format = gin.MIMEJSON
+			}
+			trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("response.content_type", format))
+			return nil
+		})
+		if format == gin.MIMEPlain {
+			c.String(http.StatusOK, message+"\n")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": message,
 		})
 	})
-	router.Run()
-}
 
-func InitTracer() func(context.Context) error {
-	exporter, err := otlptrace.New(
-		context.Background(),
-		otlptracegrpc.NewClient(otlptracegrpc.WithEndpoint(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))),
-	)
+	router.GET("/fanout", func(c *gin.Context) {
+		n, err := strconv.Atoi(c.DefaultQuery("n", "3"))
+		if err != nil || n < 1 || n > maxFanout {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("n must be a number between 1 and %d", maxFanout),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"traces": fanout(c.Request.Context(), a.tracer.Tracer(instrumentationName), n),
+		})
+	})
 
-	if err != nil {
-		panic(err)
+	router.GET("/slow", func(c *gin.Context) {
+		ms, err := strconv.Atoi(c.DefaultQuery("ms", "100"))
+		if err != nil || ms < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "ms must be a non-negative number of milliseconds",
+			})
+			return
+		}
+		// Capped so the endpoint can't be used to tie up handlers
+		duration := min(time.Duration(ms)*time.Millisecond, maxSlowDuration)
+
+		ctx, span := a.tracer.Tracer(instrumentationName).Start(c.Request.Context(), "slow.work",
+			trace.WithAttributes(attribute.Int64("duration.ms", duration.Milliseconds())),
+		)
+		defer span.End()
+		select {
+		case <-time.After(duration):
+		case <-ctx.Done():
+			// Nothing written, so the timeout middleware responds
+			span.RecordError(ctx.Err())
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"slept_ms": duration.Milliseconds(),
+		})
+	})
+
+	router.GET("/baggage", baggageMiddleware(), func(c *gin.Context) {
+		members := map[string]string{}
+		for _, member := range baggage.FromContext(c.Request.Context()).Members() {
+			members[member.Key()] = member.Value()
+		}
+		c.JSON(http.StatusOK, members)
+	})
+
+	router.GET("/ws", websocketHandler(a.tracer.Tracer(instrumentationName)))
+
+	router.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+		})
+	})
+
+	router.GET("/readyz", func(c *gin.Context) {
+		if err := ready(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "not ready",
+				"error":  err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+		})
+	})
+
+	build := buildInfo()
+	router.GET("/version", func(c *gin.Context) {
+		c.JSON(http.StatusOK, build)
+	})
+
+	// Without a token anyone could stop the service, so the route only exists with one
+	if cfg.AdminToken != "" {
+		router.POST("/admin/shutdown", adminShutdownHandler(cfg.AdminToken, a.stop))
 	}
 
-	resources, err := resource.New(
-		context.Background(),
-		resource.WithAttributes(
-			attribute.String("library.language", "go"),
-		),
-	)
-	if err != nil {
-		//log.Print("Could not set resources: ", err)
+	client := newHTTPClient(a.tracer, a.meter, a.propagator)
+	router.GET("/chain", chainHandler(client, selfURL(cfg.ListenAddr), cfg.TraceStateKey, cfg.MaxConcurrentRequests))
+
+	if upstream := cfg.UpstreamURL; upstream != "" {
+		router.GET("/proxy", func(c *gin.Context) {
+			request, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, upstream, nil)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+			response, err := client.Do(request)
+			if err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+			response.Body.Close()
+			c.JSON(http.StatusOK, gin.H{
+				"upstream": upstream,
+				"status":   response.StatusCode,
+			})
+		})
 	}
 
-	otel.SetTracerProvider(
-		tracesdk.NewTracerProvider(
-			tracesdk.WithSampler(tracesdk.AlwaysSample()),
-			tracesdk.WithBatcher(exporter),
-			tracesdk.WithResource(resources),
-		),
-	)
-	// Baggage may submit too much sensitive data for production
-	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if db != nil {
+		router.GET("/users", func(c *gin.Context) {
+			users, err := listUsers(c.Request.Context(), db)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+			c.JSON(http.StatusOK, users)
+		})
+		router.GET("/users/:id", func(c *gin.Context) {
+			user, err := getUser(c.Request.Context(), db, c.Param("id"))
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "user not found",
+				})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+			c.JSON(http.StatusOK, user)
+		})
+	}
+
+	if metricsHandler != nil {
+		router.GET("/metrics", gin.WrapH(metricsHandler))
+	}
+	if a.debugSpans != nil {
+		router.GET("/debug/spans", debugSpansHandler(a.debugSpans))
+	}
 
-	return exporter.Shutdown
+	return router, nil
+}
+
+// buildInfo reports the ldflags build information, falling back to the VCS details the Go
+// toolchain embeds when building from a checkout.
+func buildInfo() gin.H {
+	revision, date := commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && revision == "":
+				revision = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
+	}
+	return gin.H{
+		"version":   version,
+		"commit":    revision,
+		"buildDate": date,
+		"goVersion": runtime.Version(),
+	}
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"demo/spantest"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configVariables are the variables LoadConfig reads besides the OTEL_ ones.
+var configVariables = []string{
+	"ADMIN_TOKEN", "BAGGAGE_SPAN_KEYS", "CORS_ALLOWED_ORIGINS", "CRITICAL_ROUTES", "DATABASE_URL",
+	"DEBUG_SPANS", "DEBUG_SPANS_SIZE", "DEPLOYMENT_ENV", "ENABLE_BAGGAGE", "ENABLE_H2C",
+	"EXPORTER_RETRY_MAX_ELAPSED_TIME", "EXPORTER_STARTUP_CHECK", "EXPORTER_STARTUP_RETRIES",
+	"LISTEN_ADDR", "MAX_CONCURRENT_REQUESTS", "METRICS_EXPORTER", "PORT", "RATE_LIMIT",
+	"REQUEST_TIMEOUT", "REQUIRE_EXPORTER", "SAMPLER_DENY_PATHS", "SENSITIVE_HEADERS",
+	"SHUTDOWN_EXPORT_TIMEOUT", "SHUTDOWN_GRACE_PERIOD", "STRICT_TRACEPARENT", "TRACESTATE_KEY",
+	"TRUSTED_PROXIES", "UPSTREAM_URL", "USER_ID_HEADER",
+}
+
+// clearEnvironment empties every variable the service or the SDK reads for the rest of the test,
+// so a developer's or CI's OTEL settings can't leak into it. Empty counts as unset for both.
+func clearEnvironment(t *testing.T) {
+	t.Helper()
+	for _, name := range configVariables {
+		t.Setenv(name, "")
+	}
+	for _, variable := range os.Environ() {
+		if name, _, _ := strings.Cut(variable, "="); strings.HasPrefix(name, "OTEL_") {
+			t.Setenv(name, "")
+		}
+	}
+}
+
+// newTestApp creates an App with the default configuration, with configure applied on top, that
+// records its spans in memory and leaves the otel globals alone.
+func newTestApp(t *testing.T, configure func(*Config)) (*App, func() tracetest.SpanStubs) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	clearEnvironment(t)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RegisterGlobal = false
+	processor, spans := spantest.New(t)
+	cfg.SpanProcessors = []tracesdk.SpanProcessor{processor}
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	app, err := NewApp(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := app.Shutdown(context.Background()); err != nil {
+			t.Errorf("could not shut down app: %v", err)
+		}
+	})
+	return app, spans
+}
+
+// serve sends a request for target to the app's router.
+func serve(app *App, method, target string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	app.Router.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+	return recorder
+}
+
+// freeAddr returns a local address nothing listens on, for servers that have to know their own
+// address up front.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// getWhenListening retries GET url for up to a second while the server starts.
+func getWhenListening(t *testing.T, url string) *http.Response {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		response, err := http.Get(url)
+		if err == nil {
+			return response
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serverSpans are the spans otelgin created for the requests.
+func serverSpans(spans tracetest.SpanStubs) tracetest.SpanStubs {
+	var server tracetest.SpanStubs
+	for _, span := range spans {
+		if span.SpanKind == trace.SpanKindServer {
+			server = append(server, span)
+		}
+	}
+	return server
+}
+
+// attributeValue returns the value of the attribute key, and whether there is one.
+func attributeValue(attributes []attribute.KeyValue, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestPing(t *testing.T) {
+	app, spans := newTestApp(t, nil)
+
+	if code := serve(app, http.MethodGet, "/ping").Code; code != http.StatusOK {
+		t.Fatalf("GET /ping returned %d", code)
+	}
+
+	server := serverSpans(spans())
+	if len(server) != 1 || server[0].Name != "GET /ping" {
+		t.Fatalf("want one GET /ping server span, got %v", server)
+	}
+	if status, _ := attributeValue(server[0].Attributes, "http.status_code"); status.AsInt64() != http.StatusOK {
+		t.Errorf("want http.status_code 200, got %v", status.Emit())
+	}
+}
+
+func TestHealthzIsNotTraced(t *testing.T) {
+	app, spans := newTestApp(t, nil)
+
+	if code := serve(app, http.MethodGet, "/healthz").Code; code != http.StatusOK {
+		t.Fatalf("GET /healthz returned %d", code)
+	}
+	if got := spans(); len(got) != 0 {
+		t.Errorf("want no spans for /healthz, got %v", got)
+	}
+}
+
+func TestSpanStatus(t *testing.T) {
+	app, spans := newTestApp(t, func(cfg *Config) {
+		cfg.DatabaseURL = ":memory:"
+	})
+	app.Router.GET("/unavailable", func(c *gin.Context) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "unavailable"})
+	})
+
+	tests := []struct {
+		target string
+		code   int
+		want   codes.Code
+	}{
+		{"/ping", http.StatusOK, codes.Unset},
+		{"/users/42", http.StatusNotFound, codes.Unset},
+		{"/unavailable", http.StatusServiceUnavailable, codes.Error},
+	}
+	for i, test := range tests {
+		if code := serve(app, http.MethodGet, test.target).Code; code != test.code {
+			t.Fatalf("GET %s returned %d, want %d", test.target, code, test.code)
+		}
+		server := serverSpans(spans())
+		if len(server) != i+1 {
+			t.Fatalf("want a server span for GET %s, got %v", test.target, server)
+		}
+		if got := server[i].Status.Code; got != test.want {
+			t.Errorf("GET %s: want span status %v, got %v", test.target, test.want, got)
+		}
+	}
+}
+
+func TestParameterizedRouteSpanName(t *testing.T) {
+	app, spans := newTestApp(t, func(cfg *Config) {
+		cfg.DatabaseURL = ":memory:"
+	})
+
+	if code := serve(app, http.MethodGet, "/users/2").Code; code != http.StatusOK {
+		t.Fatalf("GET /users/2 returned %d", code)
+	}
+	server := serverSpans(spans())
+	if len(server) != 1 || server[0].Name != "GET /users/:id" {
+		t.Errorf("want one GET /users/:id server span, got %v", server)
+	}
+}
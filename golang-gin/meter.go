@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric/noop"
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/exemplar"
+	"log/slog"
+	"net/http"
+)
+
+// InitMeter creates a MeterProvider exporting through METRICS_EXPORTER, installing it globally
+// when cfg.RegisterGlobal is set. The provider is nil when metrics are disabled. When the exporter
+// is prometheus the returned handler serves the scrape endpoint, otherwise it is nil.
+func InitMeter(ctx context.Context, cfg Config) (*metricsdk.MeterProvider, func(context.Context) error, http.Handler, error) {
+	if cfg.SDKDisabled {
+		slog.Info("OTEL_SDK_DISABLED is set; metrics disabled")
+		return disableMetrics(cfg)
+	}
+	if cfg.MetricsExporter == "otlp" && cfg.Endpoint == "" {
+		if cfg.RequireExporter {
+			return nil, nil, nil, errors.New("OTLP endpoint not configured, set OTEL_EXPORTER_OTLP_ENDPOINT")
+		}
+		slog.Warn("OTLP endpoint not configured; metrics disabled")
+		return disableMetrics(cfg)
+	}
+
+	resources := newResource(ctx, cfg)
+
+	var reader metricsdk.Reader
+	var handler http.Handler
+	closeConn := func() error { return nil }
+	switch cfg.MetricsExporter {
+	case "otlp":
+		exporter, closeExporterConn, err := newOTLPMetricExporter(ctx, cfg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		reader = metricsdk.NewPeriodicReader(exporter)
+		closeConn = closeExporterConn
+	case "prometheus":
+		// Registers with the default Prometheus registry, which promhttp.Handler serves
+		exporter, err := prometheus.New()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("could not create metric exporter: %w", err)
+		}
+		reader = exporter
+		// Exemplars are only part of the OpenMetrics format, which Prometheus negotiates
+		handler = promhttp.HandlerFor(promclient.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported METRICS_EXPORTER %q", cfg.MetricsExporter)
+	}
+
+	meterProvider := metricsdk.NewMeterProvider(
+		metricsdk.WithReader(reader),
+		metricsdk.WithResource(resources),
+		metricsdk.WithExemplarFilter(exemplarFilter(cfg.ExemplarFilter)),
+	)
+	if cfg.RegisterGlobal {
+		otel.SetMeterProvider(meterProvider)
+	}
+
+	shutdown := func(ctx context.Context) error {
+		// Shutting down the provider collects and exports the last readings
+		return errors.Join(meterProvider.Shutdown(ctx), closeConn())
+	}
+	return meterProvider, shutdownOnce(shutdown), handler, nil
+}
+
+// newOTLPMetricExporter creates the exporter for OTEL_EXPORTER_OTLP_PROTOCOL, sharing the trace
+// exporter's settings. The returned func closes the gRPC collector connection, after the exporter.
+func newOTLPMetricExporter(ctx context.Context, cfg Config) (metricsdk.Exporter, func() error, error) {
+	switch cfg.Protocol {
+	case "grpc":
+		collector, err := newCollector(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err := otlpmetricgrpc.New(ctx,
+			otlpmetricgrpc.WithGRPCConn(collector.conn),
+			otlpmetricgrpc.WithHeaders(cfg.Headers),
+			otlpmetricgrpc.WithTimeout(cfg.ExportTimeout),
+			otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig(newExportRetry(cfg))),
+		)
+		if err != nil {
+			return nil, nil, errors.Join(fmt.Errorf("could not create metric exporter: %w", err), collector.Close())
+		}
+		return exporter, collector.Close, nil
+	case "http/protobuf":
+		options, err := metricHTTPOptions.build(cfg, "metrics")
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err := otlpmetrichttp.New(ctx, options...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not create metric exporter: %w", err)
+		}
+		return exporter, func() error { return nil }, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported OTEL_EXPORTER_OTLP_PROTOCOL %q", cfg.Protocol)
+	}
+}
+
+// metricHTTPOptions are the OTLP/HTTP metric exporter's, see otlpHTTPOptions.
+var metricHTTPOptions = otlpHTTPOptions[otlpmetrichttp.Option]{
+	endpoint:  otlpmetrichttp.WithEndpoint,
+	urlPath:   otlpmetrichttp.WithURLPath,
+	insecure:  otlpmetrichttp.WithInsecure,
+	tlsConfig: otlpmetrichttp.WithTLSClientConfig,
+	gzip:      func() otlpmetrichttp.Option { return otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression) },
+	headers:   otlpmetrichttp.WithHeaders,
+	timeout:   otlpmetrichttp.WithTimeout,
+	retry: func(r exportRetry) otlpmetrichttp.Option {
+		return otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig(r))
+	},
+}
+
+// disableMetrics installs the no-op provider in place of the SDK, nothing is exported.
+func disableMetrics(cfg Config) (*metricsdk.MeterProvider, func(context.Context) error, http.Handler, error) {
+	if cfg.RegisterGlobal {
+		otel.SetMeterProvider(noop.NewMeterProvider())
+	}
+	return nil, func(context.Context) error { return nil }, nil, nil
+}
+
+// exemplarFilter maps OTEL_METRICS_EXEMPLAR_FILTER to its filter. With the default trace_based
+// one, measurements recorded with the context of a sampled span keep that span as exemplar.
+func exemplarFilter(name string) exemplar.Filter {
+	switch name {
+	case "always_on":
+		return exemplar.AlwaysOnFilter
+	case "always_off":
+		return exemplar.AlwaysOffFilter
+	default:
+		return exemplar.TraceBasedFilter
+	}
+}
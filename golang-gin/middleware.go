@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// instrumentationName is the scope reported for the telemetry this service creates itself.
+const instrumentationName = "demo"
+
+// routeKey is the request context key routeMiddleware stores the matched route under.
+type routeKey struct{}
+
+// traceIDHeader is the response header traceIDMiddleware reports the trace ID in.
+const traceIDHeader = "X-Trace-Id"
+
+// requestIDHeader carries the request ID gateways assign, requestIDMiddleware echoes it back.
+const requestIDHeader = "X-Request-Id"
+
+// requestIDKey is the baggage member the request ID is passed on to other services in.
+const requestIDKey = "request.id"
+
+// maxRequestIDLength bounds the request IDs taken from the client, longer ones are replaced.
+const maxRequestIDLength = 128
+
+// metricsMiddleware records the semantic convention HTTP server metrics for every request.
+func metricsMiddleware(meterProvider metric.MeterProvider) (gin.HandlerFunc, error) {
+	meter := meterProvider.Meter(instrumentationName)
+	duration, err := meter.Float64Histogram(
+		"http.server.request.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of HTTP server requests."),
+		// The SDK defaults are sized for milliseconds, these are the semantic convention ones for seconds
+		metric.WithExplicitBucketBoundaries(0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10),
+	)
+	if err != nil {
+		return nil, err
+	}
+	activeRequests, err := meter.Int64UpDownCounter(
+		"http.server.active_requests",
+		metric.WithUnit("{request}"),
+		metric.WithDescription("Number of active HTTP server requests."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		method := semconv.HTTPRequestMethodKey.String(c.Request.Method)
+		activeRequests.Add(ctx, 1, metric.WithAttributes(method))
+		start := time.Now()
+
+		c.Next()
+
+		activeRequests.Add(ctx, -1, metric.WithAttributes(method))
+		attributes := []attribute.KeyValue{method, semconv.HTTPResponseStatusCode(c.Writer.Status())}
+		// Unmatched routes are left out rather than reporting the raw, unbounded path
+		if route := c.FullPath(); route != "" {
+			attributes = append(attributes, semconv.HTTPRoute(route))
+		}
+		// ctx carries the request span, which the trace based exemplar filter attaches as exemplar
+		duration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attributes...))
+	}, nil
+}
+
+// recoveryMiddleware turns a panic into a 500, recording it with its stack on the request span and
+// in the log. It has to run after otelgin.Middleware, gin's own recovery only sees the panic once
+// the span has ended.
+func recoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			err, ok := recovered.(error)
+			if !ok {
+				err = fmt.Errorf("%v", recovered)
+			}
+			// Still on the panicking goroutine's stack, so both traces lead to where it panicked
+			ctx := c.Request.Context()
+			trace.SpanFromContext(ctx).RecordError(err, trace.WithStackTrace(true))
+			// otelgin sets the Error status for the 500 itself, replacing any description, and
+			// records the message as gin.errors
+			_ = c.Error(err)
+			slog.ErrorContext(ctx, "Handler panicked", "error", err, "stack", string(debug.Stack()))
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}()
+		c.Next()
+	}
+}
+
+// sizeMiddleware adds the request and response body sizes to the request span. The route template
+// is already set as http.route by otelgin, using c.FullPath() so path parameters don't explode its
+// cardinality. Unmatched routes are skipped.
+func sizeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if c.FullPath() == "" {
+			return
+		}
+		span := trace.SpanFromContext(c.Request.Context())
+		if length := c.Request.ContentLength; length >= 0 {
+			span.SetAttributes(attribute.Int64("http.request_content_length", length))
+		}
+		if size := c.Writer.Size(); size >= 0 {
+			span.SetAttributes(attribute.Int("http.response_content_length", size))
+		}
+	}
+}
+
+// timeoutMiddleware bounds every request with timeout. Handlers, and the otelhttp client calls they
+// make, see the deadline through c.Request.Context(). Handlers are not interrupted, so one that
+// returns on the deadline without writing a response is answered with a 504. The longLivedRoutes
+// are left alone.
+func timeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if longLivedRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return
+		}
+		trace.SpanFromContext(ctx).AddEvent("request.timeout")
+		if !c.Writer.Written() {
+			c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{
+				"error": "request timed out",
+			})
+		}
+	}
+}
+
+// userMiddleware tags the request span with the caller identity from header. It has to run after
+// otelgin.Middleware so the span already exists.
+func userMiddleware(header string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if userID := c.GetHeader(header); userID != "" {
+			trace.SpanFromContext(c.Request.Context()).SetAttributes(semconv.EnduserID(userID))
+		}
+		c.Next()
+	}
+}
+
+// clientAddressMiddleware sets client.address on the request span to the client's IP, taken from
+// X-Forwarded-For when the request came through one of the TRUSTED_PROXIES, so spans show the
+// actual client rather than the load balancer. It has to run after otelgin.Middleware.
+func clientAddressMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ip := c.ClientIP(); ip != "" {
+			trace.SpanFromContext(c.Request.Context()).SetAttributes(semconv.ClientAddress(ip))
+		}
+		c.Next()
+	}
+}
+
+// samplingMiddleware copies the sample query parameter into the sampling.ratio baggage member
+// for baggageRatioSampler. It has to run before otelgin.Middleware, which makes the sampling
+// decision when it starts the span.
+func samplingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Values that are not valid baggage are ignored, as are invalid ratios later on
+		if ratio := c.Query("sample"); ratio != "" {
+			ctx := c.Request.Context()
+			if member, err := baggage.NewMember(samplingRatioKey, ratio); err == nil {
+				if bag, err := baggage.FromContext(ctx).SetMember(member); err == nil {
+					c.Request = c.Request.WithContext(baggage.ContextWithBaggage(ctx, bag))
+				}
+			}
+		}
+		c.Next()
+	}
+}
+
+// debugTraceMiddleware marks requests with an X-Debug-Trace: true header for debugSampler,
+// which samples them whatever the configured ratio. It has to run before otelgin.Middleware,
+// which makes the sampling decision when it starts the span.
+func debugTraceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if forced, _ := strconv.ParseBool(c.GetHeader("X-Debug-Trace")); forced {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), debugTraceKey{}, true))
+		}
+		c.Next()
+	}
+}
+
+// corsMiddleware allows browsers on the given origins to call the API. Without the trace context
+// headers in the allow list a browser tracing SDK's preflight fails, and without exposing them
+// the browser can't read the server's trace context from the response.
+func corsMiddleware(origins []string, userIDHeader string) (gin.HandlerFunc, error) {
+	traceHeaders := []string{"traceparent", "tracestate", "baggage"}
+	config := cors.Config{
+		AllowOrigins:  origins,
+		AllowMethods:  []string{http.MethodGet, http.MethodHead, http.MethodOptions},
+		AllowHeaders:  append([]string{"Origin", "Content-Type", userIDHeader, requestIDHeader}, traceHeaders...),
+		ExposeHeaders: append([]string{traceIDHeader, requestIDHeader}, traceHeaders...),
+		MaxAge:        12 * time.Hour,
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid CORS_ALLOWED_ORIGINS: %w", err)
+	}
+	return cors.New(config), nil
+}
+
+// rateLimitMiddleware throttles this instance to limit requests per second, allowing bursts of
+// up to one second's worth. Probes are exempt so load can't get the instance restarted. It has to
+// run after otelgin.Middleware to annotate the span.
+func rateLimitMiddleware(limit float64) gin.HandlerFunc {
+	limiter := rate.NewLimiter(rate.Limit(limit), int(math.Max(1, math.Ceil(limit))))
+	return func(c *gin.Context) {
+		if !untracedPaths[c.Request.URL.Path] && !limiter.Allow() {
+			span := trace.SpanFromContext(c.Request.Context())
+			span.AddEvent("rate_limited")
+			span.SetAttributes(attribute.Bool("rate_limit.exceeded", true))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": "rate limit exceeded",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// flushMiddleware exports the spans of the given routes as soon as the request is done, instead
+// of waiting for the next batch, so they survive the process dying right after. Every request on
+// those routes waits for the export. It has to run before otelgin.Middleware, whose span is only
+// ended once that middleware returns.
+func flushMiddleware(tracerProvider *tracesdk.TracerProvider, routes []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if !slices.Contains(routes, c.FullPath()) {
+			return
+		}
+		// Not cancelled with the request, a client going away is no reason to lose its spans
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+		if err := tracerProvider.ForceFlush(ctx); err != nil {
+			slog.WarnContext(ctx, "Could not flush spans", "route", c.FullPath(), "error", err)
+		}
+	}
+}
+
+// traceIDMiddleware returns the trace ID in the X-Trace-Id header, ready to paste into the
+// backend's search. It has to run after otelgin.Middleware so the span already exists.
+func traceIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if spanContext := trace.SpanContextFromContext(c.Request.Context()); spanContext.IsValid() {
+			c.Header(traceIDHeader, spanContext.TraceID().String())
+		}
+		c.Next()
+	}
+}
+
+// accessLogMiddleware logs one record per request, at Warn for 4xx and Error for 5xx responses.
+// It has to run after otelgin.Middleware for traceHandler to add the trace_id.
+func accessLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		path := c.FullPath()
+		if path == "" {
+			path = c.Request.URL.Path
+		}
+		slog.LogAttrs(c.Request.Context(), level, "Request served",
+			slog.String("method", c.Request.Method),
+			slog.String("path", path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		)
+	}
+}
+
+// baggageMiddleware adds every query parameter of the request to its baggage, so /baggage can
+// show incoming baggage and parameters side by side. Parameters that aren't valid baggage are
+// ignored.
+func baggageMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		bag := baggage.FromContext(ctx)
+		for key, values := range c.Request.URL.Query() {
+			member, err := baggage.NewMember(key, url.PathEscape(values[0]))
+			if err != nil {
+				continue
+			}
+			if updated, err := bag.SetMember(member); err == nil {
+				bag = updated
+			}
+		}
+		c.Request = c.Request.WithContext(baggage.ContextWithBaggage(ctx, bag))
+		c.Next()
+	}
+}
+
+// baggageSpanMiddleware copies the listed baggage members onto the span as baggage.<key>
+// attributes. Other members are never recorded, as baggage may carry data the caller didn't mean
+// to end up in the tracing backend. It has to run after otelgin.Middleware, which extracts the
+// baggage.
+func baggageSpanMiddleware(keys []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bag := baggage.FromContext(c.Request.Context())
+		span := trace.SpanFromContext(c.Request.Context())
+		for _, key := range keys {
+			if member := bag.Member(key); member.Key() != "" {
+				span.SetAttributes(attribute.String("baggage."+key, member.Value()))
+			}
+		}
+		c.Next()
+	}
+}
+
+// routeMiddleware passes the matched route on in the request context, for code that only gets
+// the request, like otelgin's span name formatter.
+func routeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if route := c.FullPath(); route != "" {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), routeKey{}, route))
+		}
+		c.Next()
+	}
+}
+
+// spanName names server spans "METHOD route", e.g. "GET /users/:id", so parameterised routes share
+// one low cardinality name. Unmatched requests fall back to their path.
+func spanName(r *http.Request) string {
+	route, ok := r.Context().Value(routeKey{}).(string)
+	if !ok {
+		route = r.URL.Path
+	}
+	return r.Method + " " + route
+}
+
+// traceStateMiddleware copies the key's tracestate entry, e.g. a vendor's sampling hint, to the
+// tracestate.<key> span attribute. The server span inherits the caller's tracestate, so it has to
+// run after otelgin.Middleware.
+func traceStateMiddleware(key string) gin.HandlerFunc {
+	attributeKey := attribute.Key("tracestate." + key)
+	return func(c *gin.Context) {
+		span := trace.SpanFromContext(c.Request.Context())
+		if value := span.SpanContext().TraceState().Get(key); value != "" {
+			span.SetAttributes(attributeKey.String(value))
+		}
+		c.Next()
+	}
+}
+
+// withTraceState returns a context whose outgoing requests carry the tracestate entry key=value.
+// It is only meant for propagation, spans can't be annotated through it. Entries that break the
+// W3C format or size limits are rejected with an error, leaving ctx to be used as it is.
+func withTraceState(ctx context.Context, key, value string) (context.Context, error) {
+	spanContext := trace.SpanContextFromContext(ctx)
+	state, err := spanContext.TraceState().Insert(key, value)
+	if err != nil {
+		return ctx, fmt.Errorf("could not add tracestate entry %s=%s: %w", key, value, err)
+	}
+	return trace.ContextWithSpanContext(ctx, spanContext.WithTraceState(state)), nil
+}
+
+// concurrencyMiddleware serves at most limit requests at a time. Requests beyond that wait for a
+// slot until their context is done, by the client going away or the request timeout, and are
+// then rejected with a 503. The longLivedRoutes don't take a slot, which they would hold for as long
+// as the connection is open. It has to run after otelgin.Middleware to annotate the span.
+func concurrencyMiddleware(limit int) gin.HandlerFunc {
+	slots := make(chan struct{}, limit)
+	return func(c *gin.Context) {
+		if longLivedRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+		ctx := c.Request.Context()
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("overload.rejected", true))
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": "too many concurrent requests",
+			})
+			return
+		}
+		defer func() { <-slots }()
+		c.Next()
+	}
+}
+
+// deadlineMiddleware applies the deadline a gateway passed in X-Request-Deadline, an RFC 3339
+// timestamp or a duration such as 250ms, or in gRPC's grpc-timeout to the request context.
+// Requests whose deadline has already passed are answered with a 504 right away. Malformed
+// headers are ignored. It has to run after otelgin.Middleware to annotate the span.
+func deadlineMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deadline, ok := requestDeadline(c.Request.Header, time.Now())
+		if !ok {
+			c.Next()
+			return
+		}
+		span := trace.SpanFromContext(c.Request.Context())
+		span.SetAttributes(attribute.String("request.deadline", deadline.Format(time.RFC3339Nano)))
+		if !time.Now().Before(deadline) {
+			span.AddEvent("deadline already exceeded")
+			c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{
+				"error": "deadline already exceeded",
+			})
+			return
+		}
+
+		ctx, cancel := context.WithDeadline(c.Request.Context(), deadline)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// grpcTimeoutUnits are the units of the grpc-timeout header.
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// maxHeaderTimeout caps the timeouts taken from the headers. 99999999H, which grpc-timeout
+// allows, would overflow a time.Duration, and REQUEST_TIMEOUT bounds the request anyway.
+const maxHeaderTimeout = 24 * time.Hour
+
+func requestDeadline(header http.Header, now time.Time) (time.Time, bool) {
+	if value := header.Get("X-Request-Deadline"); value != "" {
+		if deadline, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return deadline, true
+		}
+		if timeout, err := time.ParseDuration(value); err == nil {
+			return now.Add(min(timeout, maxHeaderTimeout)), true
+		}
+	}
+	// The spec allows at most 8 digits followed by the unit
+	if value := header.Get("grpc-timeout"); len(value) > 1 && len(value) <= 9 {
+		digits := value[:len(value)-1]
+		unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+		amount, err := strconv.ParseInt(digits, 10, 64)
+		if ok && err == nil && strings.Trim(digits, "0123456789") == "" {
+			timeout := maxHeaderTimeout
+			if amount < int64(maxHeaderTimeout/unit) {
+				timeout = time.Duration(amount) * unit
+			}
+			return now.Add(timeout), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// requestIDMiddleware takes the X-Request-Id a gateway assigned, generating one when there is
+// none, and returns it in the response. It is set on the span and added to the baggage as
+// request.id, so the outgoing calls pass it on when the baggage propagator is enabled, and a
+// service called without the header picks it up from there. It has to run after
+// otelgin.Middleware, which extracts the baggage.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			id = baggage.FromContext(ctx).Member(requestIDKey).Value()
+		}
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.NewString()
+		}
+		c.Header(requestIDHeader, id)
+
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String(requestIDKey, id))
+		// The raw member is percent-encoded when propagated, so any header value is fine
+		if member, err := baggage.NewMemberRaw(requestIDKey, id); err == nil {
+			if bag, err := baggage.FromContext(ctx).SetMember(member); err == nil {
+				c.Request = c.Request.WithContext(baggage.ContextWithBaggage(ctx, bag))
+			}
+		}
+		c.Next()
+	}
+}
+
+// traceparentPattern is the W3C traceparent format: version, trace ID, parent ID and flags. Later
+// versions may append fields.
+var traceparentPattern = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+// strictTraceparentMiddleware rejects requests with a malformed traceparent header with a 400,
+// where the propagator silently starts a new trace and hides the client's bug. It has to run after
+// otelgin.Middleware to record the invalid_traceparent event on the span of that new trace.
+func strictTraceparentMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value := c.GetHeader("traceparent")
+		if value == "" {
+			c.Next()
+			return
+		}
+		if err := validateTraceparent(value); err != nil {
+			trace.SpanFromContext(c.Request.Context()).AddEvent("invalid_traceparent", trace.WithAttributes(
+				attribute.String("traceparent", value),
+				attribute.String("error", err.Error()),
+			))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("invalid traceparent header: %v", err),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func validateTraceparent(value string) error {
+	match := traceparentPattern.FindStringSubmatch(value)
+	switch {
+	case match == nil:
+		return errors.New("must be version-traceid-parentid-flags in lowercase hex, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	case match[1] == "ff":
+		return errors.New("version ff is invalid")
+	case match[1] == "00" && match[5] != "":
+		return errors.New("version 00 has no fields after the flags")
+	case strings.Trim(match[2], "0") == "":
+		return errors.New("trace ID must not be all zeros")
+	case strings.Trim(match[3], "0") == "":
+		return errors.New("parent ID must not be all zeros")
+	}
+	return nil
+}
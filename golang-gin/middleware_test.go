@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"demo/spantest"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/codes"
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		header, value string
+		want          time.Time
+		ok            bool
+	}{
+		{"X-Request-Deadline", "2026-01-02T03:04:06Z", now.Add(time.Second), true},
+		{"X-Request-Deadline", "250ms", now.Add(250 * time.Millisecond), true},
+		{"X-Request-Deadline", "1000000h", now.Add(maxHeaderTimeout), true},
+		{"X-Request-Deadline", "soon", time.Time{}, false},
+		{"grpc-timeout", "100m", now.Add(100 * time.Millisecond), true},
+		{"grpc-timeout", "5S", now.Add(5 * time.Second), true},
+		{"grpc-timeout", "3000000H", now.Add(maxHeaderTimeout), true},
+		{"grpc-timeout", "99999999H", now.Add(maxHeaderTimeout), true},
+		{"grpc-timeout", "99999999n", now.Add(99999999 * time.Nanosecond), true},
+		{"grpc-timeout", "123456789S", time.Time{}, false},
+		{"grpc-timeout", "+5S", time.Time{}, false},
+		{"grpc-timeout", "5s", time.Time{}, false},
+		{"grpc-timeout", "S", time.Time{}, false},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		header.Set(test.header, test.value)
+		got, ok := requestDeadline(header, now)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("%s: %s gave %v, %t, want %v, %t", test.header, test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	app, spans := newTestApp(t, nil)
+	app.Router.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	if code := serve(app, http.MethodGet, "/panic").Code; code != http.StatusInternalServerError {
+		t.Fatalf("GET /panic returned %d", code)
+	}
+
+	server := serverSpans(spans())
+	if len(server) != 1 {
+		t.Fatalf("want one server span, got %v", server)
+	}
+	if status := server[0].Status.Code; status != codes.Error {
+		t.Errorf("want Error status, got %v", status)
+	}
+	if errs, _ := attributeValue(server[0].Attributes, "gin.errors"); !strings.Contains(errs.AsString(), "boom") {
+		t.Errorf("want gin.errors to carry the panic, got %q", errs.Emit())
+	}
+	if events := server[0].Events; len(events) != 1 || events[0].Name != "exception" {
+		t.Fatalf("want an exception event, got %v", events)
+	}
+	attributes := server[0].Events[0].Attributes
+	if value, _ := attributeValue(attributes, "exception.type"); value.AsString() != "*errors.errorString" {
+		t.Errorf("want exception.type *errors.errorString, got %q", value.Emit())
+	}
+	if value, _ := attributeValue(attributes, "exception.message"); value.AsString() != "boom" {
+		t.Errorf("want exception.message boom, got %q", value.Emit())
+	}
+	if value, _ := attributeValue(attributes, "exception.stacktrace"); !strings.Contains(value.AsString(), "recoveryMiddleware") {
+		t.Errorf("want exception.stacktrace through recoveryMiddleware, got %q", value.Emit())
+	}
+}
+
+func TestMetricsMiddlewareExemplar(t *testing.T) {
+	reader := metricsdk.NewManualReader()
+	meterProvider := metricsdk.NewMeterProvider(
+		metricsdk.WithReader(reader),
+		metricsdk.WithExemplarFilter(exemplarFilter("trace_based")),
+	)
+	metrics, err := metricsMiddleware(meterProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracerProvider, _ := spantest.NewProvider(t)
+	var sampled trace.SpanContext
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		ctx, span := tracerProvider.Tracer("test").Start(c.Request.Context(), "request")
+		defer span.End()
+		sampled = span.SpanContext()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}, metrics)
+	router.GET("/ping", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+
+	var collected metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &collected); err != nil {
+		t.Fatal(err)
+	}
+	for _, scope := range collected.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != "http.server.request.duration" {
+				continue
+			}
+			points := m.Data.(metricdata.Histogram[float64]).DataPoints
+			if len(points) != 1 || len(points[0].Exemplars) != 1 {
+				t.Fatalf("want one data point with an exemplar, got %v", points)
+			}
+			exemplar := points[0].Exemplars[0]
+			if trace.TraceID(exemplar.TraceID) != sampled.TraceID() || trace.SpanID(exemplar.SpanID) != sampled.SpanID() {
+				t.Errorf("want the exemplar of span %s, got trace %x span %x", sampled.SpanID(), exemplar.TraceID, exemplar.SpanID)
+			}
+			return
+		}
+	}
+	t.Fatal("http.server.request.duration was not recorded")
+}
+
+func TestValidateTraceparent(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"garbage", false},
+	}
+	for _, test := range tests {
+		if err := validateTraceparent(test.value); (err == nil) != test.valid {
+			t.Errorf("%s: got %v, want valid %t", test.value, err, test.valid)
+		}
+	}
+}
+
+func TestStrictTraceparent(t *testing.T) {
+	app, spans := newTestApp(t, func(cfg *Config) {
+		cfg.StrictTraceparent = true
+	})
+
+	tests := []struct {
+		name, traceparent string
+		code              int
+		event             bool
+	}{
+		{"valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", http.StatusOK, false},
+		{"malformed", "00-4bf92f3577b34da6a3ce929d0e0e4736-zz-01", http.StatusBadRequest, true},
+		{"absent", "", http.StatusOK, false},
+	}
+	for i, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		if test.traceparent != "" {
+			request.Header.Set("traceparent", test.traceparent)
+		}
+		recorder := httptest.NewRecorder()
+		app.Router.ServeHTTP(recorder, request)
+		if recorder.Code != test.code {
+			t.Errorf("%s: got %d, want %d", test.name, recorder.Code, test.code)
+		}
+
+		server := serverSpans(spans())
+		if len(server) != i+1 {
+			t.Fatalf("%s: want a server span, got %v", test.name, server)
+		}
+		var event bool
+		for _, e := range server[i].Events {
+			event = event || e.Name == "invalid_traceparent"
+		}
+		if event != test.event {
+			t.Errorf("%s: invalid_traceparent event recorded %t, want %t", test.name, event, test.event)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// exportRetry is the EXPORTER_RETRY_MAX_ELAPSED_TIME policy of every OTLP exporter, whatever the
+// signal or protocol. Each exporter package declares a RetryConfig with the same fields, so it
+// converts to any of them.
+type exportRetry struct {
+	Enabled         bool
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	MaxElapsedTime  time.Duration
+}
+
+func newExportRetry(cfg Config) exportRetry {
+	return exportRetry{
+		Enabled:         true,
+		InitialInterval: time.Second,
+		MaxInterval:     10 * time.Second,
+		MaxElapsedTime:  cfg.RetryMaxElapsedTime,
+	}
+}
+
+// otlpHTTPOptions are an OTLP/HTTP exporter package's option constructors, the packages share no
+// option type.
+type otlpHTTPOptions[O any] struct {
+	endpoint  func(string) O
+	urlPath   func(string) O
+	insecure  func() O
+	tlsConfig func(*tls.Config) O
+	gzip      func() O
+	headers   func(map[string]string) O
+	timeout   func(time.Duration) O
+	retry     func(exportRetry) O
+}
+
+// build configures the exporter for signal the same way for traces, metrics and logs: the
+// endpoint as otlpHTTPEndpoint derives it, TLS, compression, headers, timeout and retries.
+func (o otlpHTTPOptions[O]) build(cfg Config, signal string) ([]O, error) {
+	target, err := otlpHTTPEndpoint(cfg.Endpoint, signal, cfg.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := clientTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []O{o.headers(cfg.Headers), o.timeout(cfg.ExportTimeout), o.retry(newExportRetry(cfg))}
+	if target.host != "" {
+		options = append(options, o.endpoint(target.host))
+	}
+	if target.path != "" {
+		options = append(options, o.urlPath(target.path))
+	}
+	if target.plaintext {
+		options = append(options, o.insecure())
+	}
+	if tlsConfig != nil {
+		options = append(options, o.tlsConfig(tlsConfig))
+	}
+	if cfg.Compression == "gzip" {
+		options = append(options, o.gzip())
+	}
+	return options, nil
+}
+
+// httpEndpoint is where an OTLP/HTTP exporter sends one signal.
+type httpEndpoint struct {
+	host string
+	// path is empty for a host:port endpoint, leaving the exporter's default /v1/<signal>
+	path      string
+	plaintext bool
+}
+
+// otlpHTTPEndpoint accepts the endpoint either as host:port or as a full URL. As with the
+// generic OTEL_EXPORTER_OTLP_ENDPOINT in the spec, /v1/<signal> is appended to a URL's path,
+// and an http:// URL means plaintext.
+func otlpHTTPEndpoint(endpoint, signal string, plaintext bool) (httpEndpoint, error) {
+	if !strings.Contains(endpoint, "://") {
+		return httpEndpoint{host: endpoint, plaintext: plaintext}, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return httpEndpoint{}, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT %q: %w", endpoint, err)
+	}
+	return httpEndpoint{
+		host:      u.Host,
+		path:      path.Join("/", u.Path, "v1", signal),
+		plaintext: plaintext || u.Scheme == "http",
+	}, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOTLPHTTPEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     httpEndpoint
+	}{
+		{"collector:4318", httpEndpoint{host: "collector:4318"}},
+		{"http://collector:4318", httpEndpoint{host: "collector:4318", path: "/v1/metrics", plaintext: true}},
+		{"https://collector:4318/otlp", httpEndpoint{host: "collector:4318", path: "/otlp/v1/metrics"}},
+	}
+	for _, test := range tests {
+		got, err := otlpHTTPEndpoint(test.endpoint, "metrics", false)
+		if err != nil || got != test.want {
+			t.Errorf("%s gave %+v, %v, want %+v", test.endpoint, got, err, test.want)
+		}
+	}
+}
+
+// describedOptions stand in for an exporter package's options, describing what each one sets.
+var describedOptions = otlpHTTPOptions[string]{
+	endpoint:  func(host string) string { return "endpoint " + host },
+	urlPath:   func(path string) string { return "path " + path },
+	insecure:  func() string { return "insecure" },
+	tlsConfig: func(*tls.Config) string { return "tls" },
+	gzip:      func() string { return "gzip" },
+	headers:   func(headers map[string]string) string { return fmt.Sprint("headers ", headers) },
+	timeout:   func(timeout time.Duration) string { return fmt.Sprint("timeout ", timeout) },
+	retry:     func(r exportRetry) string { return fmt.Sprint("retry ", r.MaxElapsedTime) },
+}
+
+func TestOTLPHTTPOptions(t *testing.T) {
+	cfg := Config{
+		Endpoint:            "http://collector:4318",
+		Compression:         "gzip",
+		Headers:             map[string]string{"api-key": "secret"},
+		ExportTimeout:       5 * time.Second,
+		RetryMaxElapsedTime: time.Minute,
+	}
+	got, err := describedOptions.build(cfg, "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"headers map[api-key:secret]", "timeout 5s", "retry 1m0s", "endpoint collector:4318", "path /v1/logs", "insecure", "gzip"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got options %q, want %q", got, want)
+	}
+}
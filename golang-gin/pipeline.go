@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/time/rate"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// spanCounts follows the spans through the export pipeline, so what is left in it can be told.
+type spanCounts struct {
+	ended    atomic.Int64
+	exported atomic.Int64
+	failed   atomic.Int64
+	dropped  atomic.Int64
+	// queues are those of the batchers, set up before the counts are reported
+	queues []*spanQueue
+}
+
+// pending is the number of spans that ended and are still queued or being exported. Those that
+// failed to export or were dropped from a full queue are already lost.
+func (c *spanCounts) pending() int64 {
+	return c.ended.Load() - c.exported.Load() - c.failed.Load() - c.dropped.Load()
+}
+
+// spanQueue estimates how many spans a batch span processor holds, which it doesn't expose.
+// Spans are queued when they end and leave the queue when they are handed to the exporter.
+type spanQueue struct {
+	length   atomic.Int64
+	capacity int64
+	exporter string
+}
+
+func newSpanQueue(cfg Config, exporter string) *spanQueue {
+	capacity := int64(tracesdk.DefaultMaxQueueSize)
+	if cfg.BatchMaxQueueSize > 0 {
+		capacity = int64(cfg.BatchMaxQueueSize)
+	}
+	return &spanQueue{capacity: capacity, exporter: exporter}
+}
+
+// push queues a span, it returns false when the queue is full and the batcher drops the span.
+func (q *spanQueue) push() bool {
+	for {
+		length := q.length.Load()
+		if length >= q.capacity {
+			return false
+		}
+		if q.length.CompareAndSwap(length, length+1) {
+			return true
+		}
+	}
+}
+
+func (q *spanQueue) pop(n int) {
+	// The estimate is off by the batch being collected, don't let it drift below empty
+	if q.length.Add(-int64(n)) < 0 {
+		q.length.Store(0)
+	}
+}
+
+// countingProcessor counts the spans ended into next, a batch span processor, and those it drops
+// because its queue is full.
+type countingProcessor struct {
+	tracesdk.SpanProcessor
+	counts *spanCounts
+	queue  *spanQueue
+	// warn limits the dropped span warnings, a saturated queue drops every span
+	warn *rate.Sometimes
+}
+
+func newCountingProcessor(batcher tracesdk.SpanProcessor, counts *spanCounts, queue *spanQueue) countingProcessor {
+	return countingProcessor{batcher, counts, queue, &rate.Sometimes{First: 1, Interval: 10 * time.Second}}
+}
+
+func (p countingProcessor) OnEnd(s tracesdk.ReadOnlySpan) {
+	// The batch span processor ignores the spans that aren't sampled
+	if s.SpanContext().IsSampled() {
+		p.counts.ended.Add(1)
+		if !p.queue.push() {
+			p.counts.dropped.Add(1)
+			p.warn.Do(func() {
+				slog.Warn("Span queue full, dropping spans", "queue_size", p.queue.capacity, "dropped", p.counts.dropped.Load())
+			})
+		}
+	}
+	p.SpanProcessor.OnEnd(s)
+}
+
+// countingExporter counts the spans the batch span processor exported, and failed to export.
+type countingExporter struct {
+	tracesdk.SpanExporter
+	counts *spanCounts
+	queue  *spanQueue
+}
+
+func (e countingExporter) ExportSpans(ctx context.Context, spans []tracesdk.ReadOnlySpan) error {
+	e.queue.pop(len(spans))
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	if err == nil {
+		e.counts.exported.Add(int64(len(spans)))
+	} else {
+		e.counts.failed.Add(int64(len(spans)))
+	}
+	return err
+}
+
+// pipelineMetrics reports counts through meterProvider, so a backing up export pipeline can be
+// alerted on before spans are dropped.
+func pipelineMetrics(meterProvider metric.MeterProvider, counts *spanCounts) error {
+	meter := meterProvider.Meter(instrumentationName)
+	_, err := meter.Int64ObservableCounter(
+		"otelsdk.span.exported",
+		metric.WithUnit("{span}"),
+		metric.WithDescription("Number of spans exported successfully."),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(counts.exported.Load())
+			return nil
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = meter.Int64ObservableCounter(
+		"otelsdk.span.export.failed",
+		metric.WithUnit("{span}"),
+		metric.WithDescription("Number of spans whose export failed after all retries."),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(counts.failed.Load())
+			return nil
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = meter.Float64ObservableGauge(
+		"otelsdk.span.queue.utilization",
+		metric.WithUnit("1"),
+		metric.WithDescription("Estimated fraction of the span queue in use, per exporter."),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			for _, queue := range counts.queues {
+				utilization := float64(queue.length.Load()) / float64(queue.capacity)
+				o.Observe(utilization, metric.WithAttributes(attribute.String("exporter", queue.exporter)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = meter.Int64ObservableCounter(
+		"otel.span.dropped",
+		metric.WithUnit("{span}"),
+		metric.WithDescription("Number of spans dropped because the span queue was full."),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(counts.dropped.Load())
+			return nil
+		}),
+	)
+	return err
+}
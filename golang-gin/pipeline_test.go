@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestSpanCountsPending(t *testing.T) {
+	var counts spanCounts
+	counts.ended.Add(10)
+	counts.exported.Add(4)
+	counts.failed.Add(3)
+	counts.dropped.Add(1)
+
+	if got := counts.pending(); got != 2 {
+		t.Errorf("want 2 spans pending, got %d", got)
+	}
+}
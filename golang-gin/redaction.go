@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"slices"
+	"strings"
+)
+
+// redactedValue replaces the value of every sensitive header attribute.
+const redactedValue = "[REDACTED]"
+
+// redactionProcessor scrubs the http.request.header.* and http.response.header.* attributes of
+// the sensitive headers before passing spans on to next, so no instrumentation capturing headers
+// can leak credentials to the backend.
+type redactionProcessor struct {
+	next    tracesdk.SpanProcessor
+	headers []string
+}
+
+func newRedactionProcessor(next tracesdk.SpanProcessor, headers []string) tracesdk.SpanProcessor {
+	lower := make([]string, len(headers))
+	for i, header := range headers {
+		lower[i] = strings.ToLower(header)
+	}
+	return redactionProcessor{next: next, headers: lower}
+}
+
+func (p redactionProcessor) OnStart(parent context.Context, s tracesdk.ReadWriteSpan) {
+	if redacted, ok := p.redact(s.Attributes()); ok {
+		s.SetAttributes(redacted...)
+	}
+	p.next.OnStart(parent, s)
+}
+
+// OnEnd can't change the span, attributes set after the start are scrubbed in the view of the
+// span that is passed on instead.
+func (p redactionProcessor) OnEnd(s tracesdk.ReadOnlySpan) {
+	if redacted, ok := p.redact(s.Attributes()); ok {
+		s = redactedSpan{ReadOnlySpan: s, attributes: redacted}
+	}
+	p.next.OnEnd(s)
+}
+
+func (p redactionProcessor) Shutdown(ctx context.Context) error {
+	return p.next.Shutdown(ctx)
+}
+
+func (p redactionProcessor) ForceFlush(ctx context.Context) error {
+	return p.next.ForceFlush(ctx)
+}
+
+// redact returns a copy of attributes with the sensitive header values replaced, and whether any was.
+func (p redactionProcessor) redact(attributes []attribute.KeyValue) ([]attribute.KeyValue, bool) {
+	var redacted []attribute.KeyValue
+	for i, kv := range attributes {
+		if !p.sensitive(kv.Key) {
+			continue
+		}
+		if redacted == nil {
+			redacted = slices.Clone(attributes)
+		}
+		if kv.Value.Type() == attribute.STRINGSLICE {
+			redacted[i] = kv.Key.StringSlice([]string{redactedValue})
+		} else {
+			redacted[i] = kv.Key.String(redactedValue)
+		}
+	}
+	return redacted, redacted != nil
+}
+
+func (p redactionProcessor) sensitive(key attribute.Key) bool {
+	name, ok := strings.CutPrefix(string(key), "http.request.header.")
+	if !ok {
+		name, ok = strings.CutPrefix(string(key), "http.response.header.")
+	}
+	return ok && slices.Contains(p.headers, strings.ReplaceAll(name, "_", "-"))
+}
+
+type redactedSpan struct {
+	tracesdk.ReadOnlySpan
+	attributes []attribute.KeyValue
+}
+
+func (s redactedSpan) Attributes() []attribute.KeyValue {
+	return s.attributes
+}
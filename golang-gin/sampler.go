@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// samplingRatioKey is the baggage member that overrides the sampling ratio of a single request.
+const samplingRatioKey = "sampling.ratio"
+
+// debugTraceKey is the context key debugTraceMiddleware marks force sampled requests with.
+type debugTraceKey struct{}
+
+// newSampler builds the sampler named by OTEL_TRACES_SAMPLER, the default parentbased_always_on
+// respects upstream sampling decisions. A sampling.ratio in the baggage takes precedence, requests
+// marked by debugTraceMiddleware are always sampled, and spans for the SAMPLER_DENY_PATHS are
+// always dropped.
+func newSampler(cfg Config, ratio *ratioSampler) (tracesdk.Sampler, error) {
+	sampler, err := configuredSampler(cfg, ratio)
+	if err != nil {
+		return nil, err
+	}
+	return denyPathSampler{
+		paths:    cfg.SamplerDenyPaths,
+		delegate: debugSampler{delegate: baggageRatioSampler{fallback: sampler}},
+	}, nil
+}
+
+// configuredSampler uses ratio for the ratio based samplers, so their ratio can be changed later.
+func configuredSampler(cfg Config, ratio *ratioSampler) (tracesdk.Sampler, error) {
+	switch cfg.Sampler {
+	case "always_on":
+		return tracesdk.AlwaysSample(), nil
+	case "always_off":
+		return tracesdk.NeverSample(), nil
+	case "traceidratio":
+		return ratio, nil
+	case "parentbased_always_on":
+		return tracesdk.ParentBased(tracesdk.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return tracesdk.ParentBased(tracesdk.NeverSample()), nil
+	case "parentbased_traceidratio":
+		return tracesdk.ParentBased(ratio), nil
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER %q", cfg.Sampler)
+	}
+}
+
+// ratioSampler is a TraceIDRatioBased sampler whose ratio can be swapped while it is in use,
+// the SDK offers no way to replace a provider's sampler.
+type ratioSampler struct {
+	current atomic.Pointer[ratioState]
+}
+
+type ratioState struct {
+	ratio   float64
+	sampler tracesdk.Sampler
+}
+
+func newRatioSampler(ratio float64) *ratioSampler {
+	s := &ratioSampler{}
+	s.SetRatio(ratio)
+	return s
+}
+
+// SetRatio changes the ratio for the spans started from now on.
+func (s *ratioSampler) SetRatio(ratio float64) {
+	s.current.Store(&ratioState{ratio: ratio, sampler: tracesdk.TraceIDRatioBased(ratio)})
+}
+
+func (s *ratioSampler) ShouldSample(p tracesdk.SamplingParameters) tracesdk.SamplingResult {
+	return s.current.Load().sampler.ShouldSample(p)
+}
+
+func (s *ratioSampler) Description() string {
+	return fmt.Sprintf("ReloadableRatioSampler{%g}", s.current.Load().ratio)
+}
+
+// baggageRatioSampler samples by the ratio in the sampling.ratio baggage member, which
+// samplingMiddleware sets from the sample query parameter, so load tests can pick a rate per
+// request. Spans without a valid ratio are left to the fallback.
+type baggageRatioSampler struct {
+	fallback tracesdk.Sampler
+}
+
+func (s baggageRatioSampler) ShouldSample(p tracesdk.SamplingParameters) tracesdk.SamplingResult {
+	member := baggage.FromContext(p.ParentContext).Member(samplingRatioKey)
+	ratio, err := strconv.ParseFloat(member.Value(), 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return s.fallback.ShouldSample(p)
+	}
+	return tracesdk.TraceIDRatioBased(ratio).ShouldSample(p)
+}
+
+func (s baggageRatioSampler) Description() string {
+	return fmt.Sprintf("BaggageRatioSampler{fallback:%s}", s.fallback.Description())
+}
+
+// debugSampler forces head sampling for the requests debugTraceMiddleware marked, whatever the
+// ratio or the upstream decision, so a developer can get the trace of a single request. The
+// other spans are left to delegate.
+type debugSampler struct {
+	delegate tracesdk.Sampler
+}
+
+func (s debugSampler) ShouldSample(p tracesdk.SamplingParameters) tracesdk.SamplingResult {
+	if forced, _ := p.ParentContext.Value(debugTraceKey{}).(bool); forced {
+		return tracesdk.SamplingResult{
+			Decision:   tracesdk.RecordAndSample,
+			Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+		}
+	}
+	return s.delegate.ShouldSample(p)
+}
+
+func (s debugSampler) Description() string {
+	return fmt.Sprintf("DebugSampler{delegate:%s}", s.delegate.Description())
+}
+
+// denyPathSampler drops spans for the given paths wherever they are started, where the otelgin
+// filter only covers the server spans. The path is taken from the http.target or url.path
+// attribute, or else the span name without the method of a "GET /healthz" route name.
+type denyPathSampler struct {
+	paths    []string
+	delegate tracesdk.Sampler
+}
+
+func (s denyPathSampler) ShouldSample(p tracesdk.SamplingParameters) tracesdk.SamplingResult {
+	path := p.Name
+	if _, route, ok := strings.Cut(path, " "); ok {
+		path = route
+	}
+	for _, kv := range p.Attributes {
+		if kv.Key == semconv.URLPathKey || kv.Key == attribute.Key("http.target") {
+			path = kv.Value.AsString()
+		}
+	}
+	if slices.Contains(s.paths, path) {
+		return tracesdk.SamplingResult{
+			Decision:   tracesdk.Drop,
+			Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+		}
+	}
+	return s.delegate.ShouldSample(p)
+}
+
+func (s denyPathSampler) Description() string {
+	return fmt.Sprintf("DenyPathSampler{paths:%v,delegate:%s}", s.paths, s.delegate.Description())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+func TestRatioSamplerSetRatio(t *testing.T) {
+	sampler := newRatioSampler(0)
+	params := tracesdk.SamplingParameters{
+		ParentContext: context.Background(),
+		TraceID:       trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		Name:          "GET /ping",
+	}
+
+	if got := sampler.ShouldSample(params).Decision; got != tracesdk.Drop {
+		t.Errorf("ratio 0: got decision %v, want Drop", got)
+	}
+	sampler.SetRatio(1)
+	if got := sampler.ShouldSample(params).Decision; got != tracesdk.RecordAndSample {
+		t.Errorf("ratio 1: got decision %v, want RecordAndSample", got)
+	}
+	if got := sampler.Description(); got != "ReloadableRatioSampler{1}" {
+		t.Errorf("got description %q", got)
+	}
+}
+
+func TestDebugSampler(t *testing.T) {
+	state, err := trace.ParseTraceState("demo=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An unsampled upstream decision, which the debug mark overrides
+	parent := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceState: state,
+		Remote:     true,
+	}))
+	sampler := debugSampler{delegate: tracesdk.ParentBased(tracesdk.AlwaysSample())}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want tracesdk.SamplingDecision
+	}{
+		{"forced", context.WithValue(parent, debugTraceKey{}, true), tracesdk.RecordAndSample},
+		{"delegated", parent, tracesdk.Drop},
+	}
+	for _, test := range tests {
+		result := sampler.ShouldSample(tracesdk.SamplingParameters{
+			ParentContext: test.ctx,
+			TraceID:       trace.TraceID{1},
+			Name:          "GET /ping",
+		})
+		if result.Decision != test.want {
+			t.Errorf("%s: got decision %v, want %v", test.name, result.Decision, test.want)
+		}
+		if got := result.Tracestate.String(); got != "demo=1" {
+			t.Errorf("%s: got tracestate %q, want the parent's", test.name, got)
+		}
+	}
+}
+
+func TestDenyPathSampler(t *testing.T) {
+	sampler := denyPathSampler{paths: []string{"/healthz"}, delegate: tracesdk.AlwaysSample()}
+
+	tests := []struct {
+		name       string
+		attributes []attribute.KeyValue
+		want       tracesdk.SamplingDecision
+	}{
+		{"GET /healthz", nil, tracesdk.Drop},
+		{"/healthz", nil, tracesdk.Drop},
+		{"GET /ping", nil, tracesdk.RecordAndSample},
+		{"GET", []attribute.KeyValue{semconv.URLPath("/healthz")}, tracesdk.Drop},
+		{"GET /ping", []attribute.KeyValue{attribute.String("http.target", "/healthz")}, tracesdk.Drop},
+		{"GET /healthz", []attribute.KeyValue{semconv.URLPath("/ping")}, tracesdk.RecordAndSample},
+	}
+	for _, test := range tests {
+		result := sampler.ShouldSample(tracesdk.SamplingParameters{
+			ParentContext: context.Background(),
+			Name:          test.name,
+			Attributes:    test.attributes,
+		})
+		if result.Decision != test.want {
+			t.Errorf("%s %v: got decision %v, want %v", test.name, test.attributes, result.Decision, test.want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithSpan runs fn in a child span of ctx named name, started from tracer. An error returned by
+// fn is recorded on the span, which is marked failed, and returned. The span ends when fn
+// returns, also when it panics.
+func WithSpan(ctx context.Context, tracer trace.Tracer, name string, fn func(context.Context) error) error {
+	ctx, span := tracer.Start(ctx, name)
+	defer span.End()
+	if err := fn(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Package spantest records spans in memory so tests can assert on what a handler produced.
+//
+//	processor, spans := spantest.New(t)
+//	cfg.SpanProcessors = []tracesdk.SpanProcessor{processor}
+//	app, err := NewApp(cfg)
+//	...
+//	app.Router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+//	if got := spans(); len(got) == 0 || got[len(got)-1].Name != "GET /ping" {
+//		t.Fatalf("unexpected spans: %v", got)
+//	}
+package spantest
+
+import (
+	"context"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+// New returns a span processor exporting every span synchronously to memory, to be registered
+// with the provider under test, and a func listing the spans that have ended so far. Nothing
+// global is changed, so tests using it can run in parallel. Shutting down the provider discards
+// the recorded spans.
+func New(t testing.TB) (tracesdk.SpanProcessor, func() tracetest.SpanStubs) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	return tracesdk.NewSimpleSpanProcessor(exporter), exporter.GetSpans
+}
+
+// NewProvider returns a TracerProvider recording every span to memory, for code that takes a
+// provider rather than a processor, whatever OTEL_TRACES_SAMPLER says. It is shut down when the
+// test ends.
+func NewProvider(t testing.TB) (*tracesdk.TracerProvider, func() tracetest.SpanStubs) {
+	t.Helper()
+	processor, spans := New(t)
+	provider := tracesdk.NewTracerProvider(
+		tracesdk.WithSpanProcessor(processor),
+		tracesdk.WithSampler(tracesdk.AlwaysSample()),
+	)
+	t.Cleanup(func() {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			t.Errorf("could not shut down tracer provider: %v", err)
+		}
+	})
+	return provider, spans
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"log"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// InitTracer creates the tracer provider, installing it globally when cfg.RegisterGlobal is set.
+// The provider is nil when tracing is disabled. The ratio based samplers sample by ratio, the
+// spans going through the export pipeline are tallied in counts. The extra processors receive
+// every span besides the exporters.
+func InitTracer(ctx context.Context, cfg Config, ratio *ratioSampler, counts *spanCounts, extra ...tracesdk.SpanProcessor) (*tracesdk.TracerProvider, func(context.Context) error, func() error, error) {
+	if cfg.SDKDisabled {
+		slog.Info("OTEL_SDK_DISABLED is set; tracing disabled")
+		return disableTracing(cfg)
+	}
+
+	exporterNames := cfg.TracesExporters
+	// Without an endpoint the exporter would quietly try localhost and drop everything
+	if slices.Contains(exporterNames, "otlp") && cfg.Endpoint == "" {
+		if cfg.RequireExporter {
+			return nil, nil, nil, errors.New("OTLP endpoint not configured, set OTEL_EXPORTER_OTLP_ENDPOINT")
+		}
+		exporterNames = slices.DeleteFunc(slices.Clone(exporterNames), func(name string) bool { return name == "otlp" })
+		if len(exporterNames) == 0 && len(extra) == 0 {
+			slog.Warn("OTLP endpoint not configured; tracing disabled")
+			return disableTracing(cfg)
+		}
+		slog.Warn("OTLP endpoint not configured; OTLP trace export disabled")
+	}
+
+	sampler, err := newSampler(cfg, ratio)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	resources := newResource(ctx, cfg)
+
+	// Every exporter gets its own batcher, so a slow collector doesn't hold up the console
+	var exporters []tracesdk.SpanExporter
+	var conn *collector
+	var exporterErr error
+	for _, name := range exporterNames {
+		var exporter tracesdk.SpanExporter
+		switch name {
+		case "otlp":
+			exporter, conn, err = newOTLPExporter(ctx, cfg)
+		case "console", "stdout":
+			exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+		default:
+			err = fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q", name)
+		}
+		if err != nil {
+			exporterErr = err
+			break
+		}
+		exporters = append(exporters, exporter)
+	}
+
+	// Only the gRPC exporter keeps a connection open, the others have nothing to wait for
+	ready := func() error { return nil }
+	closeConn := func() error { return nil }
+	if conn != nil {
+		ready, closeConn = conn.Ready, conn.Close
+	}
+	if exporterErr != nil {
+		for _, exporter := range exporters {
+			exporterErr = errors.Join(exporterErr, exporter.Shutdown(ctx))
+		}
+		return nil, nil, nil, errors.Join(exporterErr, closeConn())
+	}
+
+	// The SDK reads the other OTEL_SPAN_* limits itself, this one is validated with the rest of
+	// the configuration rather than silently ignored when malformed
+	limits := tracesdk.NewSpanLimits()
+	limits.AttributeValueLengthLimit = cfg.AttributeValueLengthLimit
+
+	options := []tracesdk.TracerProviderOption{
+		tracesdk.WithSampler(sampler),
+		tracesdk.WithResource(resources),
+		tracesdk.WithSpanLimits(limits),
+	}
+	for i, exporter := range exporters {
+		// Each span is counted once per exporter, as each batcher queues its own copy
+		queue := newSpanQueue(cfg, exporterNames[i])
+		counts.queues = append(counts.queues, queue)
+		batcher := tracesdk.NewBatchSpanProcessor(countingExporter{exporter, counts, queue}, batcherOptions(cfg)...)
+		processor := newCountingProcessor(batcher, counts, queue)
+		options = append(options, tracesdk.WithSpanProcessor(newRedactionProcessor(processor, cfg.SensitiveHeaders)))
+	}
+	for _, processor := range extra {
+		options = append(options, tracesdk.WithSpanProcessor(newRedactionProcessor(processor, cfg.SensitiveHeaders)))
+	}
+	tracerProvider := tracesdk.NewTracerProvider(options...)
+	if cfg.StartupCheck {
+		if err := exportCanary(ctx, tracerProvider, cfg.ExportTimeout); err != nil {
+			return nil, nil, nil, errors.Join(err, tracerProvider.Shutdown(ctx), closeConn())
+		}
+	}
+	if cfg.RegisterGlobal {
+		otel.SetTracerProvider(tracerProvider)
+	}
+
+	shutdown := func(ctx context.Context) error {
+		if err := tracerProvider.ForceFlush(ctx); err != nil {
+			slog.Warn("Could not export all spans before shutting down", "remaining", counts.pending(), "error", err)
+		}
+		// Shutting down the provider flushes every batcher before shutting down its exporter,
+		// joining their errors. The connection is ours so it is closed last
+		return errors.Join(tracerProvider.Shutdown(ctx), closeConn())
+	}
+	return tracerProvider, shutdownOnce(shutdown), ready, nil
+}
+
+// exportCanary sends a startup.canary span through every exporter, so a misconfigured exporter
+// fails the start rather than silently losing all spans. The sampling.ratio baggage keeps the
+// configured sampler from dropping the canary.
+func exportCanary(ctx context.Context, tracerProvider *tracesdk.TracerProvider, timeout time.Duration) error {
+	member, err := baggage.NewMember(samplingRatioKey, "1")
+	if err != nil {
+		return err
+	}
+	bag, err := baggage.New(member)
+	if err != nil {
+		return err
+	}
+	_, span := tracerProvider.Tracer(instrumentationName).Start(baggage.ContextWithBaggage(ctx, bag), "startup.canary",
+		trace.WithAttributes(attribute.Bool("startup", true)),
+	)
+	span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		return fmt.Errorf("could not export the startup canary span: %w", err)
+	}
+	return nil
+}
+
+// disableTracing installs the no-op provider in place of the SDK, nothing is exported.
+func disableTracing(cfg Config) (*tracesdk.TracerProvider, func(context.Context) error, func() error, error) {
+	if cfg.RegisterGlobal {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	}
+	return nil, func(context.Context) error { return nil }, func() error { return nil }, nil
+}
+
+// shutdownOnce lets shutdown be called from both a deferred cleanup and a signal handler. Only
+// the first call shuts down, later ones wait for it to finish and return nil.
+func shutdownOnce(shutdown func(context.Context) error) func(context.Context) error {
+	var once sync.Once
+	return func(ctx context.Context) error {
+		var err error
+		once.Do(func() {
+			err = shutdown(ctx)
+		})
+		return err
+	}
+}
+
+// newOTLPExporter creates the exporter for OTEL_EXPORTER_OTLP_PROTOCOL. The gRPC one also
+// returns the collector connection, which the caller has to close after the exporter.
+func newOTLPExporter(ctx context.Context, cfg Config) (*otlptrace.Exporter, *collector, error) {
+	var client otlptrace.Client
+	var conn *collector
+	switch cfg.Protocol {
+	case "grpc":
+		var err error
+		if conn, err = newCollector(cfg); err != nil {
+			return nil, nil, err
+		}
+		// In docker-compose the collector may still be starting, give it a moment before the first export
+		waitCtx, cancel := context.WithTimeout(ctx, cfg.RetryMaxElapsedTime)
+		if err := conn.WaitReady(waitCtx, cfg.StartupRetries); err != nil {
+			log.Print("Collector is not reachable yet, exports will be retried: ", err)
+		}
+		cancel()
+		client = otlptracegrpc.NewClient(
+			otlptracegrpc.WithGRPCConn(conn.conn),
+			otlptracegrpc.WithHeaders(cfg.Headers),
+			otlptracegrpc.WithTimeout(cfg.ExportTimeout),
+			otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig(newExportRetry(cfg))),
+		)
+	case "http/protobuf":
+		options, err := traceHTTPOptions.build(cfg, "traces")
+		if err != nil {
+			return nil, nil, err
+		}
+		client = otlptracehttp.NewClient(options...)
+	default:
+		return nil, nil, fmt.Errorf("unsupported OTEL_EXPORTER_OTLP_PROTOCOL %q", cfg.Protocol)
+	}
+
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		err = fmt.Errorf("could not create trace exporter: %w", err)
+		if conn != nil {
+			err = errors.Join(err, conn.Close())
+		}
+		return nil, nil, err
+	}
+	return exporter, conn, nil
+}
+
+// batcherOptions passes on the OTEL_BSP_* settings, unset ones are left to the SDK defaults.
+func batcherOptions(cfg Config) []tracesdk.BatchSpanProcessorOption {
+	var options []tracesdk.BatchSpanProcessorOption
+	if cfg.BatchScheduleDelay > 0 {
+		options = append(options, tracesdk.WithBatchTimeout(cfg.BatchScheduleDelay))
+	}
+	if cfg.BatchExportTimeout > 0 {
+		options = append(options, tracesdk.WithExportTimeout(cfg.BatchExportTimeout))
+	}
+	if cfg.BatchMaxExportSize > 0 {
+		options = append(options, tracesdk.WithMaxExportBatchSize(cfg.BatchMaxExportSize))
+	}
+	if cfg.BatchMaxQueueSize > 0 {
+		options = append(options, tracesdk.WithMaxQueueSize(cfg.BatchMaxQueueSize))
+	}
+	return options
+}
+
+// newResource describes this service. A partially detected resource is still usable, so that
+// error is only logged. When detection fails altogether the SDK's default resource is used, with
+// the service attributes added so the spans can still be told apart. The extra options are applied
+// last.
+func newResource(ctx context.Context, cfg Config, extra ...resource.Option) *resource.Resource {
+	attributes := []attribute.KeyValue{
+		semconv.ServiceName(cfg.ServiceName),
+		attribute.String("library.language", "go"),
+		semconv.DeploymentEnvironment(cfg.Environment),
+	}
+	if cfg.ServiceVersion != "" {
+		attributes = append(attributes, semconv.ServiceVersion(cfg.ServiceVersion))
+	}
+
+	options := []resource.Option{
+		resource.WithHost(),
+		resource.WithOS(),
+		resource.WithProcess(),
+		resource.WithAttributes(attributes...),
+		// Last so OTEL_RESOURCE_ATTRIBUTES can override any of the above
+		resource.WithFromEnv(),
+	}
+	resources, err := resource.New(ctx, append(options, extra...)...)
+	if errors.Is(err, resource.ErrPartialResource) {
+		slog.Warn("Could not detect all resource attributes", "error", err)
+		return resources
+	} else if err != nil || resources == nil {
+		slog.Warn("Could not create resource, falling back to the default", "error", err)
+		fallback, mergeErr := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, attributes...))
+		if mergeErr != nil {
+			return resource.Default()
+		}
+		return fallback
+	}
+	return resources
+}
+
+// traceHTTPOptions are the OTLP/HTTP trace exporter's, see otlpHTTPOptions.
+var traceHTTPOptions = otlpHTTPOptions[otlptracehttp.Option]{
+	endpoint:  otlptracehttp.WithEndpoint,
+	urlPath:   otlptracehttp.WithURLPath,
+	insecure:  otlptracehttp.WithInsecure,
+	tlsConfig: otlptracehttp.WithTLSClientConfig,
+	gzip:      func() otlptracehttp.Option { return otlptracehttp.WithCompression(otlptracehttp.GzipCompression) },
+	headers:   otlptracehttp.WithHeaders,
+	timeout:   otlptracehttp.WithTimeout,
+	retry:     func(r exportRetry) otlptracehttp.Option { return otlptracehttp.WithRetry(otlptracehttp.RetryConfig(r)) },
+}
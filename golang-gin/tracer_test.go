@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewResource(t *testing.T) {
+	cfg := Config{ServiceName: "resource-test", Environment: "test"}
+	tests := []struct {
+		name, attributes string
+		extra            []resource.Option
+		warning          string
+		host             bool
+	}{
+		{"detected", "", nil, "", true},
+		{"partial", "malformed", nil, "Could not detect all resource attributes", true},
+		// A schema URL that conflicts with the detectors' fails detection altogether
+		{"fallback", "", []resource.Option{resource.WithSchemaURL("https://example.com/schemas/0.1.0")}, "Could not create resource, falling back to the default", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnvironment(t)
+			t.Setenv("OTEL_RESOURCE_ATTRIBUTES", test.attributes)
+			var logs bytes.Buffer
+			previous := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+			defer slog.SetDefault(previous)
+
+			resources := newResource(context.Background(), cfg, test.extra...)
+
+			attributes := resources.Set()
+			if name, _ := attributes.Value(semconv.ServiceNameKey); name.AsString() != "resource-test" {
+				t.Errorf("want service.name resource-test, got %q", name.Emit())
+			}
+			if _, ok := attributes.Value(attribute.Key("library.language")); !ok {
+				t.Error("want the library.language attribute")
+			}
+			if _, ok := attributes.Value(semconv.HostNameKey); ok != test.host {
+				t.Errorf("host.name detected %t, want %t", ok, test.host)
+			}
+			if test.warning == "" && logs.Len() != 0 {
+				t.Errorf("want no warning, got %q", logs.String())
+			}
+			if test.warning != "" && !strings.Contains(logs.String(), "level=WARN msg=\""+test.warning) {
+				t.Errorf("want the warning %q, got %q", test.warning, logs.String())
+			}
+		})
+	}
+}
+
+func TestAttributeValueLengthLimit(t *testing.T) {
+	app, spans := newTestApp(t, func(cfg *Config) {
+		cfg.AttributeValueLengthLimit = 8
+	})
+	app.Router.GET("/long", func(c *gin.Context) {
+		trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("note", strings.Repeat("x", 100)))
+		c.Status(http.StatusOK)
+	})
+
+	serve(app, http.MethodGet, "/long")
+
+	server := serverSpans(spans())
+	if len(server) != 1 {
+		t.Fatalf("want one server span, got %v", server)
+	}
+	if note, _ := attributeValue(server[0].Attributes, "note"); note.AsString() != "xxxxxxxx" {
+		t.Errorf("want note truncated to 8 characters, got %q", note.Emit())
+	}
+}
+
+func TestShutdownOnce(t *testing.T) {
+	var calls int
+	shutdown := shutdownOnce(func(context.Context) error {
+		calls++
+		return errors.New("collector unreachable")
+	})
+
+	if err := shutdown(context.Background()); err == nil {
+		t.Error("want the first call to return the shutdown error")
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("want nil from the second call, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("want shutdown to run once, ran %d times", calls)
+	}
+}
+
+func TestDisabledShutdown(t *testing.T) {
+	cfg := Config{SDKDisabled: true, LogsExporter: "otlp"}
+	tracerProvider, shutdownTracer, _, err := InitTracer(context.Background(), cfg, newRatioSampler(1), &spanCounts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracerProvider != nil {
+		t.Error("want no tracer provider when the SDK is disabled")
+	}
+	_, shutdownMeter, _, err := InitMeter(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, shutdownLogger, err := InitLogger(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, shutdown := range []func(context.Context) error{shutdownTracer, shutdownMeter, shutdownLogger} {
+		for range 2 {
+			if err := shutdown(context.Background()); err != nil {
+				t.Errorf("want nil from a disabled shutdown, got %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+)
+
+// websocketHandler upgrades the request and echoes every message back. The span otelgin started
+// for the upgrade request lasts as long as the connection, and each message gets a ws.message
+// child span of it, which the request context stops carrying once the connection is hijacked.
+func websocketHandler(tracer trace.Tracer) gin.HandlerFunc {
+	upgrader := websocket.Upgrader{}
+	return func(c *gin.Context) {
+		// Captured before the upgrade, without the request's deadline and cancellation, which
+		// say nothing about how long the connection may stay open
+		connCtx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(c.Request.Context()))
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// The upgrader has already responded with the error
+			slog.WarnContext(c.Request.Context(), "Could not upgrade to a WebSocket", "error", err)
+			return
+		}
+		defer conn.Close()
+
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					slog.WarnContext(connCtx, "WebSocket connection failed", "error", err)
+				}
+				return
+			}
+			handleMessage(connCtx, tracer, conn, messageType, message)
+		}
+	}
+}
+
+func handleMessage(ctx context.Context, tracer trace.Tracer, conn *websocket.Conn, messageType int, message []byte) {
+	_, span := tracer.Start(ctx, "ws.message",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.Int("messaging.message.body.size", len(message))),
+	)
+	defer span.End()
+
+	if err := conn.WriteMessage(messageType, message); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
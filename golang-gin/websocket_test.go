@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketOutlivesRequestLimits(t *testing.T) {
+	app, spans := newTestApp(t, func(cfg *Config) {
+		cfg.RequestTimeout = 50 * time.Millisecond
+		cfg.MaxConcurrentRequests = 1
+	})
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "hello" {
+		t.Fatalf("want the message echoed past the request timeout, got %q, %v", message, err)
+	}
+	// The only slot is free while the connection is open
+	response, err := http.Get(server.URL + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("GET /ping during the connection returned %d", response.StatusCode)
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		for _, span := range serverSpans(spans()) {
+			if span.Name != "GET /ws" {
+				continue
+			}
+			for _, event := range span.Events {
+				if event.Name == "request.timeout" {
+					t.Error("want no request.timeout event on the WebSocket span")
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the GET /ws span didn't end")
+		}
+	}
+}
+
+func TestUpgradeHeadersDontLiftRequestLimits(t *testing.T) {
+	app, _ := newTestApp(t, func(cfg *Config) {
+		cfg.RequestTimeout = 50 * time.Millisecond
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/slow?ms=300", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	recorder := httptest.NewRecorder()
+	app.Router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("GET /slow with upgrade headers returned %d, want 504", recorder.Code)
+	}
+}